@@ -0,0 +1,22 @@
+package traefik_jwt_plugin
+
+import (
+	"context"
+	"io"
+	"time"
+)
+
+// SetClock replaces the clock used by the plugin, allowing tests to control time.
+func (jwtPlugin *JwtPlugin) SetClock(now func() time.Time) {
+	jwtPlugin.now = now
+}
+
+// NextRefresh returns the delay until the next JWKS refresh.
+func (jwtPlugin *JwtPlugin) NextRefresh() time.Duration {
+	return jwtPlugin.refreshDelay()
+}
+
+// WithLogWriter returns a context which makes the plugins created with it write their log lines to the writer.
+func WithLogWriter(ctx context.Context, writer io.Writer) context.Context {
+	return context.WithValue(ctx, logWriterKey{}, writer)
+}
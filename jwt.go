@@ -2,15 +2,22 @@ package traefik_jwt_plugin
 
 import (
 	"bytes"
+	"container/heap"
+	"container/list"
 	"context"
 	"crypto"
 	"crypto/ecdsa"
+	"crypto/ed25519"
 	"crypto/elliptic"
 	"crypto/hmac"
 	"crypto/rsa"
+	"crypto/sha1"
 	"crypto/sha256"
+	"crypto/tls"
 	"crypto/x509"
+	"encoding/asn1"
 	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
 	"encoding/pem"
 	"fmt"
@@ -22,8 +29,14 @@ import (
 	"net"
 	"net/http"
 	"net/url"
+	"os"
+	"path"
+	"regexp"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -31,14 +44,299 @@ import (
 type Config struct {
 	OpaUrl        string
 	OpaAllowField string
-	PayloadFields []string
-	Required      bool
-	Keys          []string
-	Alg           string
+	// OpaTimeout limits the time of a query to OPA, including its retries (defaults to "5s")
+	OpaTimeout string
+	// OpaRetries is the number of retries of an OPA query failing with a connection error or a 502, 503 or 504
+	// status (defaults to 2, -1 disables retries)
+	OpaRetries int
+	// OpaRequestHeaders are added to the OPA queries, and OpaBearerToken is sent as "Authorization: Bearer". Values
+	// may be env:NAME or file:PATH references.
+	OpaRequestHeaders map[string]string
+	OpaBearerToken    string
+	// OpaClientCert and OpaClientKey are the PEM certificate and private key, or the paths of files containing them,
+	// presented to OPA. Files are reloaded when they change.
+	OpaClientCert string
+	OpaClientKey  string
+	// OpaTlsCa is a PEM bundle, or the path of a file containing one, with the certificate authorities trusted for an
+	// HTTPS OpaUrl in addition to the system roots
+	OpaTlsCa string
+	// OpaInsecureSkipVerify disables the verification of the certificate of OPA. Only for development.
+	OpaInsecureSkipVerify bool
+	// OpaFailureMode is either "closed" (the default), which rejects a request when OPA cannot be reached or times
+	// out, or "open", which lets it through with an X-Opa-Bypassed header. A denial by OPA is always enforced.
+	OpaFailureMode string
+	// OpaRetryBackoff is the delay before the first retry, doubled for every further retry (defaults to "50ms")
+	OpaRetryBackoff string
+	// OpaHttpStatusField and OpaBodyField are the fields of the OPA result with the status and the body of the
+	// response to a denied request
+	OpaHttpStatusField string
+	OpaBodyField       string
+	// OpaDenyStatus is the status of a denied request when the OPA result has no status (defaults to 403)
+	OpaDenyStatus int
+	// OpaHeadersField is the field of the OPA result with an object of headers to set on the allowed request
+	OpaHeadersField string
+	// OpaResponseHeadersField is the field of the OPA result with an object of headers to set on the response to a
+	// denied request
+	OpaResponseHeadersField string
+	// OpaResponseHeadersOnAllow also sets the OpaResponseHeadersField headers on the response of an allowed request
+	OpaResponseHeadersOnAllow bool
+	// OpaCacheTTL enables the cache of the OPA decisions of requests with a token, e.g. "10s". The decisions are
+	// cached by token, host, method, path, query and OpaCacheKeyHeaders, for at most OpaCacheSize requests (defaults
+	// to 10000). Denials are only cached with OpaCacheDeny, and the cache is not used with OpaIncludeBody.
+	OpaCacheTTL        string
+	OpaCacheSize       int
+	OpaCacheDeny       bool
+	OpaCacheKeyHeaders []string
+	// OpaIncludeBody sends at most OpaMaxBodySize bytes of the request body to OPA (defaults to 1048576)
+	OpaIncludeBody bool
+	OpaMaxBodySize int
+	// OpaBodyLimitMode is either "truncate" (the default), which sends the beginning of a larger body, or "deny"
+	OpaBodyLimitMode string
+	// OpaIncludeTokenRaw sends the token as sent by the client to OPA as tokenRaw
+	OpaIncludeTokenRaw bool
+	// ForwardSensitiveHeadersToOpa sends the Authorization and Proxy-Authorization headers to OPA, which are left out
+	// of the headers of the OPA input by default
+	ForwardSensitiveHeadersToOpa bool
+	// OpaHeaderDenylist lists further headers which are left out of the headers of the OPA input
+	OpaHeaderDenylist []string
+	// OpaCookies restricts the cookies of the OPA input to the listed names (defaults to all cookies)
+	OpaCookies []string
+	// RouteName is sent to OPA as the routeName of the input, along with the name of the middleware
+	RouteName string
+	// OpaExtraInput is sent to OPA as the context of the input, e.g. to tell the environment to the policy
+	OpaExtraInput map[string]interface{}
+	// TrustedProxies lists the CIDRs (or IPs) of the proxies whose X-Forwarded-For entries are trusted for the
+	// clientIP of the OPA input
+	TrustedProxies []string
+	PayloadFields  []string
+	// RequireClaims maps a claim name to the expected value, or a list of accepted values
+	RequireClaims map[string]interface{}
+	// ClaimRegex maps a claim name to a regular expression which the claim value must match
+	ClaimRegex map[string]string
+	// ClaimAssertions compares claims with configured values
+	ClaimAssertions []ClaimAssertion
+	// ClaimAllowedValues maps a claim name to the set of acceptable string or numeric values
+	ClaimAllowedValues map[string][]interface{}
+	// ClaimAllowedValuesMatchArray accepts array claims when any of their elements is an allowed value
+	ClaimAllowedValuesMatchArray bool
+	// ClaimExpression is a boolean expression over the payload, e.g. payload.level >= 3 && payload.env == "prod"
+	ClaimExpression string
+	// PathClaims overrides RequireClaims for requests matching a path prefix
+	PathClaims []PathClaimRule
+	// MethodRules overrides RequiredScopes and RequireClaims for requests with a given HTTP method
+	MethodRules map[string]MethodRule
+	// PathClaimBinding lists path patterns like "/users/{sub}" whose named segments must equal the claim values
+	PathClaimBinding []string
+	// RequiredScopes lists the scopes which must be present in the scope claim
+	RequiredScopes []string
+	// RequireAnyScope accepts tokens which contain at least one of the RequiredScopes instead of all of them
+	RequireAnyScope bool
+	// ScopeClaim is the name of the claim containing the scopes (defaults to "scope", Azure AD uses "scp")
+	ScopeClaim string
+	// RequiredRoles lists the roles which must be present in the roles claim
+	RequiredRoles []string
+	// RolesClaimPath is the path of the roles claim (defaults to the Keycloak realm roles "realm_access.roles")
+	RolesClaimPath string
+	// ResourceAccess requires Keycloak client roles, found in resource_access.<client>.roles
+	ResourceAccess ResourceAccessConfig
+	// RequiredGroups requires membership of at least one of the groups in the groups claim
+	RequiredGroups []string
+	// GroupsClaim is the name of the groups claim (defaults to the Cognito claim "cognito:groups")
+	GroupsClaim string
+	// RequiredAmr requires at least one of the authentication methods in the amr claim, e.g. "mfa"
+	RequiredAmr []string
+	// RequiredAcr is the required acr claim, or the minimum acr when AcrValues is set
+	RequiredAcr string
+	// AcrValues orders the acr values from the weakest to the strongest
+	AcrValues []string
+	// SubjectDenylist rejects tokens for the listed sub claims
+	SubjectDenylist []string
+	// SubjectAllowlist only accepts tokens for the listed sub claims
+	SubjectAllowlist []string
+	// AllowedEmailDomains only accepts tokens whose email claim belongs to one of the domains
+	AllowedEmailDomains []string
+	// EmailClaim is the name of the email claim (defaults to "email")
+	EmailClaim string
+	// TenantClaim is the name of the claim which must match the tenant taken from the Host header
+	TenantClaim string
+	// TenantFromHost selects the component of the Host header holding the tenant: "subdomain" (the default, the
+	// leftmost label) or "host" (the full hostname)
+	TenantFromHost string
+	// TenantHostMapping maps host components to tenant claim values when they differ
+	TenantHostMapping map[string]string
+	Required          bool
+	Keys              []string
+	// KeysByKid maps a kid to a certificate or public key (PEM, der: or file://), for static keys whose kid is known
+	KeysByKid map[string]string
+	// KeyFileReloadInterval is the interval for re-reading the file:// Keys (defaults to "1m")
+	KeyFileReloadInterval string
+	// Secrets maps a kid to a shared secret for the HS* algorithms, prefixed with its encoding: "base64:" or "plain:"
+	Secrets map[string]string
+	// Issuers configures a separate key set and audience per issuer. Tokens are verified with the keys of the
+	// issuer matching their iss claim, tokens from other issuers are rejected.
+	Issuers []IssuerConfig
+	// Alg is superseded by Algs
+	Alg  string
+	Algs []string
+	Iss  string
+	// Aud is superseded by Audiences
+	Aud       string
+	Audiences []string
+	// Azp is the client ID which must match the azp (authorized party) claim when present
+	Azp string
+	// RequireAzpForMultipleAudiences requires the azp claim when the aud claim contains more than one audience
+	RequireAzpForMultipleAudiences bool
+	OpaHeaders                     map[string]string
+	// JwtHeaders is deprecated, use HeaderMappings. It maps header names to claim names.
+	JwtHeaders map[string]string
+	// HeaderMappings inject claims of the token as request headers
+	HeaderMappings []HeaderMapping
+	// KeyRetentionPeriod keeps keys removed from a JWKS endpoint for the given duration (e.g. "1h")
+	KeyRetentionPeriod string
+	// RequireKid rejects tokens without a kid header before verifying them
+	RequireKid bool
+	// MinRsaKeyBits is the minimum size of RSA keys (defaults to 2048, -1 disables the check)
+	MinRsaKeyBits int
+	// MinRsaKeyBitsMode is either "reject" (the default), which refuses smaller keys, or "warn", which only logs them
+	MinRsaKeyBitsMode string
+	// KeyAlgMatch is either "exact" (the default), which only uses a JWKS key declaring an alg for tokens with that
+	// alg, or "family", which also accepts other algorithms of the same family (e.g. RS512 for an RS256 key)
+	KeyAlgMatch string
+	// StrictKid rejects tokens whose kid does not match a key, instead of trying all keys
+	StrictKid bool
+	// UnknownKidCacheSize bounds the number of remembered unknown kids (defaults to 1000, -1 disables the cache)
+	UnknownKidCacheSize int
+	// UnknownKidCacheTTL is how long a kid which matched no key is rejected without trying all keys (defaults to "1m")
+	UnknownKidCacheTTL string
+	// StrictKeyRotation rejects a JWKS key published under a known kid with different material
+	StrictKeyRotation bool
+	// AllowUnencodedPayload accepts RFC 7797 tokens with the "b64": false header, signed over the unencoded payload
+	AllowUnencodedPayload bool
+	// PssSaltLength is the required salt length of PS256, PS384 and PS512 signatures: "auto" (the default) accepts
+	// any, "hash" the size of the hash, or a number of bytes, e.g. "0"
+	PssSaltLength string
+	// StrictEcdsaSignatures only accepts the R||S form of ECDSA signatures, rejecting ASN.1 DER encoded signatures
+	StrictEcdsaSignatures bool
+	// OidcDiscovery loads the keys from the jwks_uri of the OpenID configuration of the Iss
+	OidcDiscovery bool
+	// JwksImportAllKeys also imports JWKS keys whose use or key_ops exclude signature verification
+	JwksImportAllKeys bool
+	// JwksFetchTimeout limits the time to fetch a JWKS endpoint or OpenID configuration (defaults to "5s")
+	JwksFetchTimeout string
+	// JwksTlsCa is a PEM bundle, or the path of a file containing one, with the certificate authorities trusted for
+	// HTTPS JWKS endpoints and OIDC discovery in addition to the system roots
+	JwksTlsCa string
+	// JwksInsecureSkipVerify disables the verification of the certificates of the JWKS endpoints. Only for development.
+	JwksInsecureSkipVerify bool
+	// JwksProxyUrl is the HTTP proxy for the JWKS requests. Without it, HTTPS_PROXY, HTTP_PROXY and NO_PROXY apply.
+	JwksProxyUrl string
+	// ConfigReportPath is a path answered with the ConfigReport as JSON, instead of forwarding the request, for GET
+	// requests which are authenticated by a token or a client certificate and pass the OPA check, e.g. "/_jwt/config"
+	ConfigReportPath string
+	// JwksRequestHeaders are added to the JWKS requests, e.g. an Authorization header. Values may be env:NAME
+	// references.
+	JwksRequestHeaders map[string]string
+	// JwksFetchRetries is the number of retries when the initial JWKS fetch fails (defaults to 3, -1 disables retries)
+	JwksFetchRetries int
+	// JwksRetryBackoff is the delay before the first retry, doubled for every further retry (defaults to "500ms")
+	JwksRetryBackoff string
+	// JwksStartupFailureMode is either "fail" (the default) or "background", which starts without keys and keeps
+	// retrying in the background
+	JwksStartupFailureMode string
+	// LazyKeys defers the OIDC discovery and the JWKS fetch until the first request with a token
+	LazyKeys bool
+	// JwksDuplicateKidMode is either "warn" (the default), which keeps the first key published under a kid, or
+	// "error", which fails the endpoint publishing a different key under a kid already in use
+	JwksDuplicateKidMode string
+	// JwksRefreshInterval is the interval for re-fetching the JWKS endpoints (defaults to "15m")
+	JwksRefreshInterval string
+	// AlternativeAuth allows requests without a valid JWT to be authenticated by another mechanism ("clientCert")
+	AlternativeAuth string
+	ClientCert      ClientCertConfig
+	// RevocationUrl returns a JSON array of revoked jti values (or an object with a "revoked" array)
+	RevocationUrl string
+	// RevocationRefreshInterval is the interval for refreshing the revocation list (defaults to "1m")
+	RevocationRefreshInterval string
+	// RevocationFailureMode controls the behavior when the revocation list cannot be refreshed: "keep" (default)
+	// keeps the last known list, "closed" rejects all tokens and "open" discards the list
+	RevocationFailureMode string
+	// ReplayProtection rejects tokens whose jti has already been seen, and tokens without a jti
+	ReplayProtection bool
+	// ReplayCacheSize bounds the number of remembered jti values (defaults to 10000). When all of them are unexpired,
+	// new tokens are rejected rather than forgetting a jti which could then be replayed.
+	ReplayCacheSize int
+	// ReplayTTL is how long jti values are remembered at least, tokens with a later exp being remembered until their
+	// exp (defaults to "1h")
+	ReplayTTL string
+	// RequiredTyp is the required typ header of the token, e.g. "at+jwt"
+	RequiredTyp string
+	// ClaimLookupCaseInsensitive folds case when looking up claim names
+	ClaimLookupCaseInsensitive bool
+	// MaxAuthAge rejects tokens whose auth_time claim is older than the duration, e.g. "15m"
+	MaxAuthAge string
+	// Leeway is the allowed clock skew for time based checks, e.g. "30s"
+	Leeway string
+}
+
+// ClaimAssertion compares a claim with a value, using one of the operators eq, ne, gt, ge, lt or le. Boolean values
+// only support eq and ne.
+type ClaimAssertion struct {
+	Claim string
+	Op    string
+	Value interface{}
+	// Lenient also accepts the strings "true" and "false" for boolean claims, as sent by some identity providers
+	Lenient bool
+}
+
+// IssuerConfig configures the keys and audiences accepted for tokens from one issuer. Iss may contain '*' wildcards
+// like the top-level Iss. Without Aud and Audiences, the top-level audiences apply.
+type IssuerConfig struct {
 	Iss           string
+	Keys          []string
+	KeysByKid     map[string]string
+	Secrets       map[string]string
+	OidcDiscovery bool
 	Aud           string
-	OpaHeaders    map[string]string
-	JwtHeaders    map[string]string
+	Audiences     []string
+}
+
+// PathClaimRule configures the required claims for requests whose path starts with PathPrefix. The rule with the
+// longest matching prefix wins, a rule with an empty PathPrefix is the default.
+type PathClaimRule struct {
+	PathPrefix    string
+	RequireClaims map[string]interface{}
+}
+
+// MethodRule configures the requirements for requests with a given HTTP method. RequiredScopes and RequireClaims
+// replace the global options when set. SkipAuth passes requests through without checking them, e.g. for CORS
+// preflight (OPTIONS) requests which carry no token.
+type MethodRule struct {
+	RequiredScopes []string
+	RequireClaims  map[string]interface{}
+	SkipAuth       bool
+}
+
+// HeaderMapping injects the claim of the token, when present, as the request header
+type HeaderMapping struct {
+	Header string
+	Claim  string
+}
+
+// ResourceAccessConfig configures the required Keycloak client roles
+type ResourceAccessConfig struct {
+	Client string
+	Roles  []string
+}
+
+// ClientCertConfig configures client certificate authentication
+type ClientCertConfig struct {
+	// CAs contains the PEM encoded certificate authorities which may issue client certificates
+	CAs []string
+	// SANs restricts the accepted client certificates by DNS, email, URI or IP subject alternative name
+	SANs []string
+	// TrustForwardedHeader accepts the certificate from the X-Forwarded-Tls-Client-Cert header, which is only
+	// safe when the header is set by the Traefik PassTLSClientCert middleware
+	TrustForwardedHeader bool
 }
 
 // CreateConfig creates a new OPA Config
@@ -48,20 +346,159 @@ func CreateConfig() *Config {
 
 // JwtPlugin contains the runtime config
 type JwtPlugin struct {
-	next          http.Handler
-	opaUrl        string
-	opaAllowField string
-	payloadFields []string
-	required      bool
-	jwkEndpoints  []*url.URL
-	keys          map[string]interface{}
-	alg           string
-	iss           string
-	aud           string
-	opaHeaders    map[string]string
-	jwtHeaders    map[string]string
+	// opaTimeouts and opaErrors count the failed OPA queries. They come first to be 64-bit aligned for atomic access
+	opaTimeouts     uint64
+	opaErrors       uint64
+	next            http.Handler
+	opaUrl          string
+	opaAllowField   string
+	opaStatusField  string
+	opaBodyField    string
+	opaDenyStatus   int
+	opaHeadersField string
+	// opaResponseHeadersField and opaResponseHeadersOnAllow configure the response headers set by OPA
+	opaResponseHeadersField   string
+	opaResponseHeadersOnAllow bool
+	opaIncludeBody            bool
+	opaMaxBodySize            int
+	opaBodyLimitDeny          bool
+	opaIncludeTokenRaw        bool
+	trustedProxies            []*net.IPNet
+	opaCookies                []string
+	opaExtraInput             map[string]interface{}
+	// opaCache holds the OPA results of recent requests, when OpaCacheTTL is set
+	opaCache           *opaDecisionCache
+	opaCacheDeny       bool
+	opaCacheKeyHeaders []string
+	// name is the name of the middleware given by Traefik
+	name      string
+	routeName string
+	// opaHeaderDenylist holds the headers left out of the OPA input
+	opaHeaderDenylist []string
+	payloadFields     []string
+	requireClaims     map[string]interface{}
+	claimRegex        map[string]*regexp.Regexp
+	assertions        []claimAssertion
+	allowedValues     map[string][]interface{}
+	allowedMatchArray bool
+	expression        claimExpression
+	pathClaims        []PathClaimRule
+	methodRules       map[string]MethodRule
+	pathBindings      [][]pathSegment
+	scopes            []string
+	anyScope          bool
+	scopeClaim        string
+	roles             []string
+	rolesClaim        string
+	resourceAccess    ResourceAccessConfig
+	groups            []string
+	groupsClaim       string
+	amr               []string
+	acr               string
+	acrValues         []string
+	subjectDenylist   map[string]struct{}
+	subjectAllowlist  map[string]struct{}
+	emailDomains      []string
+	emailClaim        string
+	tenantClaim       string
+	tenantFromHost    string
+	tenantMapping     map[string]string
+	required          bool
+	jwkEndpoints      []*url.URL
+	keys              *keyStore
+	algs              []string
+	iss               string
+	issPattern        *regexp.Regexp
+	// keyFiles holds the keys loaded from local files
+	keyFiles        []*keyFile
+	keyFileInterval time.Duration
+	// issuers holds a plugin per configured issuer, which verifies the tokens of that issuer
+	issuers      []*JwtPlugin
+	audiences    []string
+	azp          string
+	requireAzp   bool
+	configReport ConfigReport
+	// configReportPath is the ConfigReportPath answered with the configReport
+	configReportPath string
+	opaHeaders       map[string]string
+	// opaClient is shared by the OPA queries, so that connections are kept alive
+	opaClient       *http.Client
+	opaTimeout      time.Duration
+	opaRetries      int
+	opaRetryBackoff time.Duration
+	opaFailOpen     bool
+	// opaRequestHeaders holds the resolved OpaRequestHeaders and OpaBearerToken
+	opaRequestHeaders map[string]string
+	headerMappings    []HeaderMapping
+	// jwksKeys holds the keys most recently loaded from the JWKS endpoints
+	jwksKeys map[string]interface{}
+	// keySources holds the JWKS endpoint each of the jwksKeys was loaded from
+	keySources       map[string]string
+	keyAlgFamily     bool
+	unencodedPayload bool
+	// algorithms holds the verification of each JWS algorithm, the tokenAlgorithms adjusted to the configuration
+	algorithms  map[string]tokenAlgorithm
+	minRsaBits  int
+	rsaBitsWarn bool
+	// retiredKeys holds the expiry of JWKS keys which are no longer published. Together with the jwksKeys and the
+	// keySources it is only used by the refresh, under the fetch lock.
+	retiredKeys        map[string]time.Time
+	keyRetentionPeriod time.Duration
+	strictKeyRotation  bool
+	strictKid          bool
+	requireKid         bool
+	refreshInterval    time.Duration
+	jwksClient         *http.Client
+	jwksHeaders        map[string]string
+	importAllKeys      bool
+	duplicateKidError  bool
+	fetchRetries       int
+	retryBackoff       time.Duration
+	lazyKeys           bool
+	// keysPending is set while not all JWK endpoints have been fetched, so that the BackgroundRefresh retries them
+	keysPending int32
+	// lazyLoaded is set once the keys of the LazyKeys mode have been loaded
+	lazyLoaded int32
+	lazyLock   sync.Mutex
+	// lazyRetry is the earliest time of the next attempt to load the keys of the LazyKeys mode
+	lazyRetry time.Time
+	// lazyDiscovery is the issuer whose OIDC discovery is deferred by the LazyKeys mode
+	lazyDiscovery string
+	// background is the context of the background loops and their fetches, cancelled by stop
+	background     context.Context
+	stop           context.CancelFunc
+	jwksErrors     map[string]string
+	jwksErrorsLock sync.Mutex
+	fetchLock      sync.Mutex
+	jwksCache      map[string]jwksResponse
+	nextRefresh    time.Duration
+	now            func() time.Time
+	// logWriter receives the JSON log lines, os.Stdout unless a writer is passed in the context of New
+	logWriter          io.Writer
+	alternativeAuth    string
+	clientCAs          *x509.CertPool
+	clientSANs         []string
+	trustCertHeader    bool
+	revocationUrl      string
+	revocationInterval time.Duration
+	revocationFailure  string
+	revocationLock     sync.RWMutex
+	revoked            map[string]struct{}
+	revocationFailed   bool
+	replayCache        *replayCache
+	// unknownKids remembers the kids which matched no key, so the fallback over all keys is not repeated
+	unknownKids *replayCache
+	requiredTyp string
+	maxAuthAge  time.Duration
+	foldClaims  bool
+	leeway      time.Duration
 }
 
+const (
+	authMethodJwt        = "jwt"
+	authMethodClientCert = "clientCert"
+)
+
 // LogEvent contains a single log entry
 type LogEvent struct {
 	Level   string    `json:"level"`
@@ -70,6 +507,40 @@ type LogEvent struct {
 	Network `json:"network"`
 	URL     string `json:"url"`
 	Sub     string `json:"sub"`
+	Kid     string `json:"kid,omitempty"`
+	// Alg is the alg declared by a key
+	Alg string `json:"alg,omitempty"`
+	// Source is where a key was loaded from: a JWKS endpoint, a key file or "configuration"
+	Source string `json:"source,omitempty"`
+	// KeyCount is the number of keys of a key store event, included when zero
+	KeyCount *int `json:"keyCount,omitempty"`
+	// AuthMethod is the mechanism which authenticated the request
+	AuthMethod string `json:"authMethod,omitempty"`
+	// Migrations lists the legacy configuration fields in use
+	Migrations []MigrationEntry `json:"migrations,omitempty"`
+	// OpaFailure is "timeout" or "error" for a failed OPA query, and OpaFailureCount the number of such failures
+	OpaFailure      string `json:"opaFailure,omitempty"`
+	OpaFailureCount uint64 `json:"opaFailureCount,omitempty"`
+}
+
+// ConfigReport describes which configuration field each effective setting was taken from, and which legacy
+// configuration fields are still in use
+type ConfigReport struct {
+	Provenance map[string]string `json:"provenance"`
+	Migrations []MigrationEntry  `json:"migrations,omitempty"`
+	// JwksRequestHeaders lists the configured JWKS request headers, with redacted values
+	JwksRequestHeaders map[string]string `json:"jwksRequestHeaders,omitempty"`
+	// OpaRequestHeaders lists the headers of the OPA queries, with redacted values
+	OpaRequestHeaders map[string]string `json:"opaRequestHeaders,omitempty"`
+}
+
+// MigrationEntry describes a legacy configuration field and its replacement
+type MigrationEntry struct {
+	Field       string `json:"field"`
+	Value       string `json:"value"`
+	Replacement string `json:"replacement"`
+	// Ignored is true when the replacement field is configured as well and takes precedence
+	Ignored bool `json:"ignored,omitempty"`
 }
 
 type Network struct {
@@ -87,6 +558,11 @@ type JwtHeader struct {
 	Typ  string   `json:"typ"`
 	Cty  string   `json:"cty"`
 	Crit []string `json:"crit"`
+	// B64 is the RFC 7797 header, false for tokens signed over the unencoded payload
+	B64 *bool `json:"b64"`
+	// X5t and X5tS256 are the base64url SHA-1 and SHA-256 thumbprints of the signing certificate, as sent by ADFS
+	X5t     string `json:"x5t"`
+	X5tS256 string `json:"x5t#S256"`
 }
 
 type JWT struct {
@@ -94,6 +570,10 @@ type JWT struct {
 	Signature []byte
 	Header    JwtHeader
 	Payload   map[string]interface{}
+	// Wrapper is the enclosing token of a nested token (cty "JWT")
+	Wrapper *JWT
+	// Raw is the compact serialization of the token
+	Raw string
 }
 
 var supportedHeaderNames = map[string]struct{}{"alg": {}, "kid": {}, "typ": {}, "cty": {}, "crit": {}}
@@ -106,18 +586,21 @@ type Key struct {
 	Use string   `json:"use"`
 	X5c []string `json:"x5c"`
 	X5t string   `json:"x5t"`
-	N   string   `json:"n"`
-	E   string   `json:"e"`
-	K   string   `json:"k,omitempty"`
-	X   string   `json:"x,omitempty"`
-	Y   string   `json:"y,omitempty"`
-	D   string   `json:"d,omitempty"`
-	P   string   `json:"p,omitempty"`
-	Q   string   `json:"q,omitempty"`
-	Dp  string   `json:"dp,omitempty"`
-	Dq  string   `json:"dq,omitempty"`
-	Qi  string   `json:"qi,omitempty"`
-	Crv string   `json:"crv,omitempty"`
+	// X5tS256 is the base64url SHA-256 thumbprint of the certificate
+	X5tS256 string   `json:"x5t#S256"`
+	KeyOps  []string `json:"key_ops"`
+	N       string   `json:"n"`
+	E       string   `json:"e"`
+	K       string   `json:"k,omitempty"`
+	X       string   `json:"x,omitempty"`
+	Y       string   `json:"y,omitempty"`
+	D       string   `json:"d,omitempty"`
+	P       string   `json:"p,omitempty"`
+	Q       string   `json:"q,omitempty"`
+	Dp      string   `json:"dp,omitempty"`
+	Dq      string   `json:"dq,omitempty"`
+	Qi      string   `json:"qi,omitempty"`
+	Crv     string   `json:"crv,omitempty"`
 }
 
 // Keys represents a set of JSON web keys.
@@ -136,7 +619,51 @@ type PayloadInput struct {
 	JWTHeader  JwtHeader              `json:"tokenHeader"`
 	JWTPayload map[string]interface{} `json:"tokenPayload"`
 	Body       map[string]interface{} `json:"body,omitempty"`
-	Form       url.Values             `json:"form,omitempty"`
+	// Cookies maps the cookie names to their first value, CookieValues to all values of repeated names
+	Cookies      map[string]string   `json:"cookies,omitempty"`
+	CookieValues map[string][]string `json:"cookieValues,omitempty"`
+	// Scheme and Port are the scheme and port requested by the client, and URL the requested URL with its raw query
+	Scheme string `json:"scheme"`
+	Port   int    `json:"port"`
+	URL    string `json:"url"`
+	// ClientIP is the address of the client, taken from X-Forwarded-For when the request comes from a TrustedProxies
+	ClientIP string `json:"clientIP"`
+	// RemoteAddr is the address of the connection, usually the address and port of the last proxy
+	RemoteAddr string `json:"remoteAddr"`
+	// TLS describes the TLS connection of the request, if any
+	TLS *PayloadTLS `json:"tls,omitempty"`
+	// Middleware is the name of the middleware in Traefik, and RouteName the RouteName of the configuration
+	Middleware string `json:"middleware,omitempty"`
+	RouteName  string `json:"routeName,omitempty"`
+	// Context holds the OpaExtraInput of the configuration
+	Context map[string]interface{} `json:"context,omitempty"`
+	// TokenRaw is the compact token as sent by the client, with OpaIncludeTokenRaw
+	TokenRaw string `json:"tokenRaw,omitempty"`
+	// RawBody is the body of the OpaIncludeBody mode when it is not a JSON object
+	RawBody string `json:"rawBody,omitempty"`
+	// BodyTruncated is set when the body exceeds the OpaMaxBodySize, so that RawBody only holds its beginning
+	BodyTruncated bool       `json:"bodyTruncated,omitempty"`
+	Form          url.Values `json:"form,omitempty"`
+	AuthMethod    string     `json:"authMethod,omitempty"`
+}
+
+// PayloadTLS is the TLS connection of a request in the OPA input. When Traefik terminated TLS and forwarded the
+// client certificate in the X-Forwarded-Tls-Client-Cert header, only the certificates are known and Forwarded is set.
+type PayloadTLS struct {
+	Version          string               `json:"version,omitempty"`
+	CipherSuite      string               `json:"cipherSuite,omitempty"`
+	Forwarded        bool                 `json:"forwarded,omitempty"`
+	PeerCertificates []PayloadCertificate `json:"peerCertificates,omitempty"`
+}
+
+// PayloadCertificate is a peer certificate in the OPA input
+type PayloadCertificate struct {
+	Subject  string   `json:"subject"`
+	Issuer   string   `json:"issuer"`
+	DNSNames []string `json:"dnsNames,omitempty"`
+	// FingerprintSHA256 is the hex encoded SHA-256 of the DER certificate
+	FingerprintSHA256 string    `json:"fingerprintSha256"`
+	NotAfter          time.Time `json:"notAfter"`
 }
 
 // Payload for OPA requests
@@ -149,372 +676,4792 @@ type Response struct {
 	Result map[string]json.RawMessage `json:"result"`
 }
 
-// New creates a new plugin
-func New(_ context.Context, next http.Handler, config *Config, _ string) (http.Handler, error) {
+// logWriterKey is the context key of the writer of the log lines, which the tests use to capture them
+type logWriterKey struct{}
+
+// New creates a new plugin. Its background loops run until Close is called or the ctx is done.
+func New(ctx context.Context, next http.Handler, config *Config, name string) (handler http.Handler, err error) {
+	var issuers []*JwtPlugin
+	if len(config.Issuers) > 0 {
+		var err error
+		if issuers, err = newIssuers(ctx, config, name); err != nil {
+			return nil, err
+		}
+		// the keys and the issuer of the flat configuration have been moved to the issuers
+		flat := *config
+		flat.Keys, flat.KeysByKid, flat.Secrets, flat.Iss, flat.OidcDiscovery = nil, nil, nil, "", false
+		config = &flat
+	}
 	jwtPlugin := &JwtPlugin{
-		next:          next,
-		opaUrl:        config.OpaUrl,
-		opaAllowField: config.OpaAllowField,
-		payloadFields: config.PayloadFields,
-		required:      config.Required,
-		alg:           config.Alg,
-		iss:           config.Iss,
-		aud:           config.Aud,
-		keys:          make(map[string]interface{}),
-		jwtHeaders:    config.JwtHeaders,
-		opaHeaders:    config.OpaHeaders,
+		issuers:                   issuers,
+		next:                      next,
+		opaUrl:                    config.OpaUrl,
+		opaAllowField:             config.OpaAllowField,
+		opaStatusField:            config.OpaHttpStatusField,
+		opaBodyField:              config.OpaBodyField,
+		opaDenyStatus:             config.OpaDenyStatus,
+		opaHeadersField:           config.OpaHeadersField,
+		opaResponseHeadersField:   config.OpaResponseHeadersField,
+		opaResponseHeadersOnAllow: config.OpaResponseHeadersOnAllow,
+		opaIncludeBody:            config.OpaIncludeBody,
+		opaMaxBodySize:            config.OpaMaxBodySize,
+		opaIncludeTokenRaw:        config.OpaIncludeTokenRaw,
+		opaCookies:                config.OpaCookies,
+		opaCacheDeny:              config.OpaCacheDeny,
+		opaCacheKeyHeaders:        config.OpaCacheKeyHeaders,
+		name:                      name,
+		configReportPath:          config.ConfigReportPath,
+		routeName:                 config.RouteName,
+		payloadFields:             config.PayloadFields,
+		requireClaims:             config.RequireClaims,
+		scopes:                    config.RequiredScopes,
+		anyScope:                  config.RequireAnyScope,
+		scopeClaim:                config.ScopeClaim,
+		roles:                     config.RequiredRoles,
+		rolesClaim:                config.RolesClaimPath,
+		resourceAccess:            config.ResourceAccess,
+		groups:                    config.RequiredGroups,
+		groupsClaim:               config.GroupsClaim,
+		required:                  config.Required,
+		iss:                       config.Iss,
+		requiredTyp:               normalizeTyp(config.RequiredTyp),
+		foldClaims:                config.ClaimLookupCaseInsensitive,
+		azp:                       config.Azp,
+		requireAzp:                config.RequireAzpForMultipleAudiences,
+		keys:                      newKeyStore(),
+		opaHeaders:                config.OpaHeaders,
+		jwksKeys:                  make(map[string]interface{}),
+		keySources:                make(map[string]string),
+		jwksCache:                 make(map[string]jwksResponse),
+		retiredKeys:               make(map[string]time.Time),
+		strictKeyRotation:         config.StrictKeyRotation,
+		unencodedPayload:          config.AllowUnencodedPayload,
+		strictKid:                 config.StrictKid,
+		requireKid:                config.RequireKid,
+		importAllKeys:             config.JwksImportAllKeys,
+		now:                       time.Now,
+		logWriter:                 os.Stdout,
+	}
+	if logWriter, ok := ctx.Value(logWriterKey{}).(io.Writer); ok {
+		jwtPlugin.logWriter = logWriter
+	}
+	jwtPlugin.background, jwtPlugin.stop = context.WithCancel(context.Background())
+	defer func() {
+		if err != nil {
+			_ = jwtPlugin.Close()
+		} else if ctx.Done() != nil {
+			go func() {
+				select {
+				case <-ctx.Done():
+					_ = jwtPlugin.Close()
+				case <-jwtPlugin.background.Done():
+				}
+			}()
+		}
+	}()
+	if config.KeyRetentionPeriod != "" {
+		keyRetentionPeriod, err := time.ParseDuration(config.KeyRetentionPeriod)
+		if err != nil {
+			return nil, fmt.Errorf("invalid KeyRetentionPeriod: %v", err)
+		}
+		jwtPlugin.keyRetentionPeriod = keyRetentionPeriod
+	}
+	if jwtPlugin.opaDenyStatus == 0 {
+		jwtPlugin.opaDenyStatus = http.StatusForbidden
+	} else if !denialStatus(jwtPlugin.opaDenyStatus) {
+		return nil, fmt.Errorf("invalid OpaDenyStatus %d, expecting a status between 300 and 599", jwtPlugin.opaDenyStatus)
+	}
+	if !config.ForwardSensitiveHeadersToOpa {
+		jwtPlugin.opaHeaderDenylist = append(jwtPlugin.opaHeaderDenylist, "Authorization", "Proxy-Authorization")
+	}
+	if len(config.OpaExtraInput) > 0 {
+		extraInput := jsonValue(config.OpaExtraInput).(map[string]interface{})
+		if _, err := json.Marshal(extraInput); err != nil {
+			return nil, fmt.Errorf("invalid OpaExtraInput: %s", err)
+		}
+		jwtPlugin.opaExtraInput = extraInput
+	}
+	if len(config.OpaCookies) > 0 {
+		// the cookies which are not allowed are not sent in the Cookie header either
+		jwtPlugin.opaHeaderDenylist = append(jwtPlugin.opaHeaderDenylist, "Cookie")
+	}
+	jwtPlugin.opaHeaderDenylist = append(jwtPlugin.opaHeaderDenylist, config.OpaHeaderDenylist...)
+	for _, proxy := range config.TrustedProxies {
+		trusted, err := parseTrustedProxy(proxy)
+		if err != nil {
+			return nil, err
+		}
+		jwtPlugin.trustedProxies = append(jwtPlugin.trustedProxies, trusted)
+	}
+	if jwtPlugin.opaMaxBodySize == 0 {
+		jwtPlugin.opaMaxBodySize = 1 << 20
+	} else if jwtPlugin.opaMaxBodySize < 0 {
+		return nil, fmt.Errorf("invalid OpaMaxBodySize %d", jwtPlugin.opaMaxBodySize)
+	}
+	switch config.OpaFailureMode {
+	case "", "closed":
+	case "open":
+		jwtPlugin.opaFailOpen = true
+	default:
+		return nil, fmt.Errorf("unsupported OpaFailureMode %s, expecting closed or open", config.OpaFailureMode)
+	}
+	switch config.OpaBodyLimitMode {
+	case "", "truncate":
+	case "deny":
+		jwtPlugin.opaBodyLimitDeny = true
+	default:
+		return nil, fmt.Errorf("unsupported OpaBodyLimitMode %s, expecting truncate or deny", config.OpaBodyLimitMode)
+	}
+	if jwtPlugin.opaUrl != "" {
+		jwtPlugin.opaTimeout = 5 * time.Second
+		if config.OpaTimeout != "" {
+			timeout, err := time.ParseDuration(config.OpaTimeout)
+			if err != nil || timeout <= 0 {
+				return nil, fmt.Errorf("invalid OpaTimeout: %s", config.OpaTimeout)
+			}
+			jwtPlugin.opaTimeout = timeout
+		}
+		jwtPlugin.opaRetries = config.OpaRetries
+		if jwtPlugin.opaRetries == 0 {
+			jwtPlugin.opaRetries = 2
+		}
+		jwtPlugin.opaRetryBackoff = 50 * time.Millisecond
+		if config.OpaRetryBackoff != "" {
+			backoff, err := time.ParseDuration(config.OpaRetryBackoff)
+			if err != nil || backoff <= 0 {
+				return nil, fmt.Errorf("invalid OpaRetryBackoff: %s", config.OpaRetryBackoff)
+			}
+			jwtPlugin.opaRetryBackoff = backoff
+		}
+		transport, err := jwtPlugin.opaTransport(config)
+		if err != nil {
+			return nil, err
+		}
+		for name, value := range config.OpaRequestHeaders {
+			value, err := resolveSecret(value)
+			if err != nil {
+				return nil, fmt.Errorf("OpaRequestHeaders %s: %v", name, err)
+			}
+			if jwtPlugin.opaRequestHeaders == nil {
+				jwtPlugin.opaRequestHeaders = make(map[string]string)
+			}
+			jwtPlugin.opaRequestHeaders[http.CanonicalHeaderKey(name)] = value
+		}
+		if config.OpaBearerToken != "" {
+			if _, ok := jwtPlugin.opaRequestHeaders["Authorization"]; ok {
+				return nil, fmt.Errorf("OpaBearerToken conflicts with the Authorization header of OpaRequestHeaders")
+			}
+			token, err := resolveSecret(config.OpaBearerToken)
+			if err != nil {
+				return nil, fmt.Errorf("OpaBearerToken: %v", err)
+			}
+			if jwtPlugin.opaRequestHeaders == nil {
+				jwtPlugin.opaRequestHeaders = make(map[string]string)
+			}
+			jwtPlugin.opaRequestHeaders["Authorization"] = "Bearer " + token
+		}
+		// the OpaTimeout is the deadline of the context of a query, which covers the retries
+		jwtPlugin.opaClient = &http.Client{Transport: transport}
+		if config.OpaCacheTTL != "" {
+			ttl, err := time.ParseDuration(config.OpaCacheTTL)
+			if err != nil || ttl <= 0 {
+				return nil, fmt.Errorf("invalid OpaCacheTTL: %s", config.OpaCacheTTL)
+			}
+			size := 10000
+			if config.OpaCacheSize > 0 {
+				size = config.OpaCacheSize
+			} else if config.OpaCacheSize < 0 {
+				return nil, fmt.Errorf("invalid OpaCacheSize %d", config.OpaCacheSize)
+			}
+			jwtPlugin.opaCache = newOpaDecisionCache(size, ttl)
+		}
+	}
+	jwtPlugin.jwksClient = &http.Client{Timeout: 5 * time.Second}
+	if config.JwksFetchTimeout != "" {
+		timeout, err := time.ParseDuration(config.JwksFetchTimeout)
+		if err != nil || timeout <= 0 {
+			return nil, fmt.Errorf("invalid JwksFetchTimeout: %s", config.JwksFetchTimeout)
+		}
+		jwtPlugin.jwksClient.Timeout = timeout
+	}
+	for name, value := range config.JwksRequestHeaders {
+		value, err := resolveEnv(value)
+		if err != nil {
+			return nil, fmt.Errorf("JwksRequestHeaders %s: %v", name, err)
+		}
+		if jwtPlugin.jwksHeaders == nil {
+			jwtPlugin.jwksHeaders = make(map[string]string)
+		}
+		jwtPlugin.jwksHeaders[name] = value
+	}
+	if config.JwksTlsCa != "" || config.JwksInsecureSkipVerify || config.JwksProxyUrl != "" {
+		transport, err := jwtPlugin.jwksTransport(config)
+		if err != nil {
+			return nil, err
+		}
+		jwtPlugin.jwksClient.Transport = transport
+	}
+	jwtPlugin.fetchRetries = config.JwksFetchRetries
+	if jwtPlugin.fetchRetries == 0 {
+		jwtPlugin.fetchRetries = 3
+	}
+	jwtPlugin.retryBackoff = 500 * time.Millisecond
+	if config.JwksRetryBackoff != "" {
+		backoff, err := time.ParseDuration(config.JwksRetryBackoff)
+		if err != nil || backoff <= 0 {
+			return nil, fmt.Errorf("invalid JwksRetryBackoff: %s", config.JwksRetryBackoff)
+		}
+		jwtPlugin.retryBackoff = backoff
+	}
+	switch config.JwksStartupFailureMode {
+	case "", "fail", "background":
+	default:
+		return nil, fmt.Errorf("unsupported JwksStartupFailureMode %s, expecting fail or background", config.JwksStartupFailureMode)
+	}
+	jwtPlugin.minRsaBits = config.MinRsaKeyBits
+	if jwtPlugin.minRsaBits == 0 {
+		jwtPlugin.minRsaBits = 2048
+	}
+	switch config.MinRsaKeyBitsMode {
+	case "", "reject":
+	case "warn":
+		jwtPlugin.rsaBitsWarn = true
+	default:
+		return nil, fmt.Errorf("unsupported MinRsaKeyBitsMode %s, expecting reject or warn", config.MinRsaKeyBitsMode)
+	}
+	switch config.KeyAlgMatch {
+	case "", "exact":
+	case "family":
+		jwtPlugin.keyAlgFamily = true
+	default:
+		return nil, fmt.Errorf("unsupported KeyAlgMatch %s, expecting exact or family", config.KeyAlgMatch)
+	}
+	switch config.JwksDuplicateKidMode {
+	case "", "warn":
+	case "error":
+		jwtPlugin.duplicateKidError = true
+	default:
+		return nil, fmt.Errorf("unsupported JwksDuplicateKidMode %s, expecting warn or error", config.JwksDuplicateKidMode)
+	}
+	jwtPlugin.refreshInterval = 15 * time.Minute
+	if config.JwksRefreshInterval != "" {
+		interval, err := time.ParseDuration(config.JwksRefreshInterval)
+		if err != nil || interval <= 0 {
+			return nil, fmt.Errorf("invalid JwksRefreshInterval: %s", config.JwksRefreshInterval)
+		}
+		jwtPlugin.refreshInterval = interval
+	}
+	if config.MaxAuthAge != "" {
+		maxAuthAge, err := time.ParseDuration(config.MaxAuthAge)
+		if err != nil || maxAuthAge <= 0 {
+			return nil, fmt.Errorf("invalid MaxAuthAge: %s", config.MaxAuthAge)
+		}
+		jwtPlugin.maxAuthAge = maxAuthAge
+	}
+	if config.Leeway != "" {
+		leeway, err := time.ParseDuration(config.Leeway)
+		if err != nil || leeway < 0 {
+			return nil, fmt.Errorf("invalid Leeway: %s", config.Leeway)
+		}
+		jwtPlugin.leeway = leeway
+	}
+	jwtPlugin.resolveConfig(config)
+	for _, alg := range jwtPlugin.algs {
+		if _, ok := tokenAlgorithms[alg]; !ok {
+			return nil, fmt.Errorf("unsupported alg %s in Algs", alg)
+		}
+	}
+	for _, mapping := range jwtPlugin.headerMappings {
+		if mapping.Header == "" || mapping.Claim == "" {
+			return nil, fmt.Errorf("invalid HeaderMappings: a mapping requires Header and Claim")
+		}
+	}
+	if err := jwtPlugin.configureAlgorithms(config); err != nil {
+		return nil, err
+	}
+	if err := jwtPlugin.configureAlternativeAuth(config); err != nil {
+		return nil, err
+	}
+	jwtPlugin.claimRegex = make(map[string]*regexp.Regexp)
+	for name, pattern := range config.ClaimRegex {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid ClaimRegex for claim %s: %v", name, err)
+		}
+		jwtPlugin.claimRegex[name] = re
+	}
+	for _, assertion := range config.ClaimAssertions {
+		compiled, err := compileClaimAssertion(assertion)
+		if err != nil {
+			return nil, err
+		}
+		jwtPlugin.assertions = append(jwtPlugin.assertions, compiled)
+	}
+	for name, values := range config.ClaimAllowedValues {
+		if len(values) == 0 {
+			return nil, fmt.Errorf("ClaimAllowedValues for claim %s is empty", name)
+		}
+		for _, value := range values {
+			if _, isString := value.(string); isString {
+				continue
+			}
+			if _, ok := toFloat(value); !ok {
+				return nil, fmt.Errorf("ClaimAllowedValues for claim %s contains a value which is not a string or a number", name)
+			}
+		}
+	}
+	jwtPlugin.allowedValues = config.ClaimAllowedValues
+	prefixes := make(map[string]bool)
+	for _, rule := range config.PathClaims {
+		if prefixes[rule.PathPrefix] {
+			return nil, fmt.Errorf("duplicate PathClaims rule for path prefix %q", rule.PathPrefix)
+		}
+		prefixes[rule.PathPrefix] = true
+		jwtPlugin.pathClaims = append(jwtPlugin.pathClaims, rule)
+	}
+	sort.SliceStable(jwtPlugin.pathClaims, func(i, j int) bool {
+		return len(jwtPlugin.pathClaims[i].PathPrefix) > len(jwtPlugin.pathClaims[j].PathPrefix)
+	})
+	for _, pattern := range config.PathClaimBinding {
+		segments, err := compilePathBinding(pattern)
+		if err != nil {
+			return nil, err
+		}
+		jwtPlugin.pathBindings = append(jwtPlugin.pathBindings, segments)
+	}
+	jwtPlugin.methodRules = make(map[string]MethodRule)
+	for method, rule := range config.MethodRules {
+		method = strings.ToUpper(method)
+		if _, ok := jwtPlugin.methodRules[method]; ok {
+			return nil, fmt.Errorf("duplicate MethodRules entry for method %s", method)
+		}
+		jwtPlugin.methodRules[method] = rule
+	}
+	jwtPlugin.allowedMatchArray = config.ClaimAllowedValuesMatchArray
+	if config.ClaimExpression != "" {
+		expression, err := compileClaimExpression(config.ClaimExpression)
+		if err != nil {
+			return nil, fmt.Errorf("invalid ClaimExpression: %v", err)
+		}
+		jwtPlugin.expression = expression
+	}
+	if jwtPlugin.scopeClaim == "" {
+		jwtPlugin.scopeClaim = "scope"
+	}
+	if jwtPlugin.rolesClaim == "" {
+		jwtPlugin.rolesClaim = "realm_access.roles"
+	}
+	if jwtPlugin.groupsClaim == "" {
+		jwtPlugin.groupsClaim = "cognito:groups"
+	}
+	if len(config.SubjectDenylist) > 0 && len(config.SubjectAllowlist) > 0 {
+		return nil, fmt.Errorf("SubjectDenylist and SubjectAllowlist are mutually exclusive")
+	}
+	jwtPlugin.subjectDenylist = stringSet(config.SubjectDenylist)
+	jwtPlugin.subjectAllowlist = stringSet(config.SubjectAllowlist)
+	if config.RequiredAcr != "" && len(config.AcrValues) > 0 && !containsString(config.AcrValues, config.RequiredAcr) {
+		return nil, fmt.Errorf("RequiredAcr %s is not one of the AcrValues", config.RequiredAcr)
+	}
+	jwtPlugin.amr = config.RequiredAmr
+	jwtPlugin.acr = config.RequiredAcr
+	jwtPlugin.acrValues = config.AcrValues
+	for _, domain := range config.AllowedEmailDomains {
+		jwtPlugin.emailDomains = append(jwtPlugin.emailDomains, "@"+strings.ToLower(strings.TrimPrefix(domain, "@")))
+	}
+	jwtPlugin.emailClaim = config.EmailClaim
+	if jwtPlugin.emailClaim == "" {
+		jwtPlugin.emailClaim = "email"
+	}
+	if err := jwtPlugin.configureTenant(config); err != nil {
+		return nil, err
+	}
+	if len(config.ResourceAccess.Roles) > 0 && config.ResourceAccess.Client == "" {
+		return nil, fmt.Errorf("ResourceAccess.Roles requires ResourceAccess.Client")
+	}
+	if strings.Contains(config.Iss, "*") {
+		jwtPlugin.issPattern = compileIssuerPattern(config.Iss)
 	}
 	if err := jwtPlugin.ParseKeys(config.Keys); err != nil {
 		return nil, err
 	}
+	if err := jwtPlugin.ParseKeysByKid(config.KeysByKid); err != nil {
+		return nil, err
+	}
+	if err := jwtPlugin.ParseSecrets(config.Secrets); err != nil {
+		return nil, err
+	}
+	if err := jwtPlugin.configureKeyFiles(config); err != nil {
+		return nil, err
+	}
+	jwtPlugin.lazyKeys = config.LazyKeys
+	if config.OidcDiscovery {
+		if config.Iss == "" || jwtPlugin.issPattern != nil {
+			return nil, fmt.Errorf("OidcDiscovery requires an Iss without wildcards")
+		}
+	}
+	if config.OidcDiscovery && config.LazyKeys {
+		jwtPlugin.lazyDiscovery = config.Iss
+	} else if config.OidcDiscovery {
+		jwksUri, err := jwtPlugin.discoverJwksUri(ctx, config.Iss)
+		if err != nil {
+			return nil, fmt.Errorf("OIDC discovery for issuer %s failed: %v", config.Iss, err)
+		}
+		jwtPlugin.jwkEndpoints = append(jwtPlugin.jwkEndpoints, jwksUri)
+	}
+	if err := jwtPlugin.configureRevocation(ctx, config); err != nil {
+		return nil, err
+	}
+	if config.ReplayProtection {
+		size, ttl := 10000, time.Hour
+		if config.ReplayCacheSize > 0 {
+			size = config.ReplayCacheSize
+		}
+		if config.ReplayTTL != "" {
+			var err error
+			if ttl, err = time.ParseDuration(config.ReplayTTL); err != nil || ttl <= 0 {
+				return nil, fmt.Errorf("invalid ReplayTTL: %s", config.ReplayTTL)
+			}
+		}
+		jwtPlugin.replayCache = newReplayCache(size, ttl)
+	}
+	if config.UnknownKidCacheSize >= 0 && !config.StrictKid {
+		size, ttl := 1000, time.Minute
+		if config.UnknownKidCacheSize > 0 {
+			size = config.UnknownKidCacheSize
+		}
+		if config.UnknownKidCacheTTL != "" {
+			var err error
+			if ttl, err = time.ParseDuration(config.UnknownKidCacheTTL); err != nil || ttl <= 0 {
+				return nil, fmt.Errorf("invalid UnknownKidCacheTTL: %s", config.UnknownKidCacheTTL)
+			}
+		}
+		jwtPlugin.unknownKids = newReplayCache(size, ttl)
+		// the unknown kids are only an optimization, the kid expiring first makes room for a new one
+		jwtPlugin.unknownKids.evictLive = true
+	}
+	if jwtPlugin.lazyKeys {
+		jwtPlugin.logKeyEvent("info", "Deferring the JWKS fetch until the first request with a token", "")
+		return jwtPlugin, nil
+	}
+	if !jwtPlugin.fetchKeysWithRetry(ctx) {
+		if config.JwksStartupFailureMode != "background" {
+			var failures []string
+			for u, err := range jwtPlugin.JwksErrors() {
+				failures = append(failures, u+": "+err)
+			}
+			sort.Strings(failures)
+			return nil, fmt.Errorf("failed to fetch the JWKS keys: %s", strings.Join(failures, ", "))
+		}
+		jwtPlugin.logKeyEvent("warning", "Starting without all JWKS keys, retrying in the background", "")
+		jwtPlugin.setKeysPending(true)
+	}
+	if len(jwtPlugin.issuers) == 0 {
+		count := len(jwtPlugin.keys.All())
+		if count == 0 {
+			jwtPlugin.logKeyStoreEvent(LogEvent{Level: "warning", Msg: "Plugin started without keys", KeyCount: keyCount(0)})
+		} else {
+			jwtPlugin.logKeyStoreEvent(LogEvent{Level: "info", Msg: "Plugin started with keys", KeyCount: keyCount(count)})
+		}
+	}
 	go jwtPlugin.BackgroundRefresh()
 	return jwtPlugin, nil
 }
 
-func (jwtPlugin *JwtPlugin) BackgroundRefresh() {
-	for {
-		jwtPlugin.FetchKeys()
-		time.Sleep(15 * time.Minute) // 15 min
+// configureAlgorithms adjusts the verification of the tokenAlgorithms to the StrictEcdsaSignatures and the
+// PssSaltLength
+func (jwtPlugin *JwtPlugin) configureAlgorithms(config *Config) error {
+	pssVerify := verifyRSAPSS
+	switch config.PssSaltLength {
+	case "", "auto":
+	case "hash":
+		pssVerify = verifyRSAPSSSaltLength(rsa.PSSSaltLengthEqualsHash)
+	default:
+		saltLength, err := strconv.Atoi(config.PssSaltLength)
+		if err != nil || saltLength < 0 {
+			return fmt.Errorf("invalid PssSaltLength: %s, expecting auto, hash or a number of bytes", config.PssSaltLength)
+		}
+		pssVerify = verifyRSAPSSSaltLength(saltLength)
 	}
-}
-
-func (jwtPlugin *JwtPlugin) ParseKeys(certificates []string) error {
-	for _, certificate := range certificates {
-		if block, rest := pem.Decode([]byte(certificate)); block != nil {
-			if len(rest) > 0 {
-				return fmt.Errorf("extra data after a PEM certificate block")
-			}
-			if block.Type == "CERTIFICATE" {
-				cert, err := x509.ParseCertificate(block.Bytes)
-				if err != nil {
-					return fmt.Errorf("failed to parse a PEM certificate: %v", err)
-				}
-				jwtPlugin.keys[base64.RawURLEncoding.EncodeToString(cert.SubjectKeyId)] = cert.PublicKey
-			} else if block.Type == "PUBLIC KEY" || block.Type == "RSA PUBLIC KEY" {
-				key, err := x509.ParsePKIXPublicKey(block.Bytes)
-				if err != nil {
-					return fmt.Errorf("failed to parse a PEM public key: %v", err)
-				}
-				jwtPlugin.keys[strconv.Itoa(len(jwtPlugin.keys))] = key
-			} else {
-				return fmt.Errorf("failed to extract a Key from the PEM certificate")
+	jwtPlugin.algorithms = make(map[string]tokenAlgorithm, len(tokenAlgorithms))
+	for name, algorithm := range tokenAlgorithms {
+		switch algFamily(name) {
+		case "ES":
+			if !config.StrictEcdsaSignatures {
+				algorithm.verify = verifyAsymmetric(verifyECDSAOrDer)
 			}
-		} else if u, err := url.ParseRequestURI(certificate); err == nil {
-			jwtPlugin.jwkEndpoints = append(jwtPlugin.jwkEndpoints, u)
-		} else {
-			return fmt.Errorf("Invalid configuration, expecting a certificate, public key or JWK URL")
+		case "PS":
+			algorithm.verify = verifyAsymmetric(pssVerify)
 		}
+		jwtPlugin.algorithms[name] = algorithm
 	}
+	return nil
+}
 
+func (jwtPlugin *JwtPlugin) configureRevocation(ctx context.Context, config *Config) error {
+	if config.RevocationUrl == "" {
+		return nil
+	}
+	jwtPlugin.revocationUrl = config.RevocationUrl
+	jwtPlugin.revocationInterval = time.Minute
+	if config.RevocationRefreshInterval != "" {
+		interval, err := time.ParseDuration(config.RevocationRefreshInterval)
+		if err != nil || interval <= 0 {
+			return fmt.Errorf("invalid RevocationRefreshInterval: %s", config.RevocationRefreshInterval)
+		}
+		jwtPlugin.revocationInterval = interval
+	}
+	switch config.RevocationFailureMode {
+	case "":
+		jwtPlugin.revocationFailure = "keep"
+	case "keep", "closed", "open":
+		jwtPlugin.revocationFailure = config.RevocationFailureMode
+	default:
+		return fmt.Errorf("unsupported RevocationFailureMode %s, expecting keep, closed or open", config.RevocationFailureMode)
+	}
+	jwtPlugin.fetchRevocations(ctx)
+	go func() {
+		for jwtPlugin.sleep(jwtPlugin.revocationInterval) {
+			jwtPlugin.fetchRevocations(jwtPlugin.background)
+		}
+	}()
 	return nil
 }
 
-func (jwtPlugin *JwtPlugin) FetchKeys() {
-	for _, u := range jwtPlugin.jwkEndpoints {
-		response, err := http.Get(u.String())
-		if err != nil {
-			// TODO: log warning
-			continue
+// FetchRevocations refreshes the list of revoked jti values. When the list cannot be fetched, the
+// RevocationFailureMode decides whether the last known list is kept, discarded, or all tokens are rejected.
+func (jwtPlugin *JwtPlugin) FetchRevocations() {
+	jwtPlugin.fetchRevocations(context.Background())
+}
+
+func (jwtPlugin *JwtPlugin) fetchRevocations(ctx context.Context) {
+	revoked, err := jwtPlugin.fetchRevocationList(ctx)
+	jwtPlugin.revocationLock.Lock()
+	defer jwtPlugin.revocationLock.Unlock()
+	if err != nil {
+		jwtPlugin.revocationFailed = true
+		if jwtPlugin.revocationFailure == "open" {
+			jwtPlugin.revoked = nil
 		}
-		body, err := ioutil.ReadAll(response.Body)
-		if err != nil {
-			// TODO: log warning
-			continue
+		jsonLogEvent, _ := json.Marshal(&LogEvent{
+			Level: "warning",
+			Msg:   fmt.Sprintf("Failed to refresh the revocation list (failure mode %s): %v", jwtPlugin.revocationFailure, err),
+			Time:  jwtPlugin.now(),
+		})
+		_, _ = fmt.Fprintln(jwtPlugin.logWriter, string(jsonLogEvent))
+		return
+	}
+	jwtPlugin.revoked = revoked
+	jwtPlugin.revocationFailed = false
+}
+
+// fetchRevocationList fetches the revoked jti values with the client of the JWKS endpoints, so that the
+// JwksFetchTimeout bounds a revocation endpoint which does not answer
+func (jwtPlugin *JwtPlugin) fetchRevocationList(ctx context.Context) (map[string]struct{}, error) {
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, jwtPlugin.revocationUrl, nil)
+	if err != nil {
+		return nil, err
+	}
+	response, err := jwtPlugin.jwksClient.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %d", response.StatusCode)
+	}
+	body, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return nil, err
+	}
+	var jtis []string
+	if err = json.Unmarshal(body, &jtis); err != nil {
+		var wrapped struct {
+			Revoked []string `json:"revoked"`
 		}
-		var jwksKeys Keys
-		err = json.Unmarshal(body, &jwksKeys)
-		if err != nil {
-			// TODO: log warning
-			continue
+		if err = json.Unmarshal(body, &wrapped); err != nil {
+			return nil, err
 		}
-		for _, key := range jwksKeys.Keys {
-			switch key.Kty {
-			case "RSA":
-				{
-					if key.Kid == "" {
-						key.Kid, err = JWKThumbprint(fmt.Sprintf(`{"e":"%s","kty":"RSA","n":"%s"}`, key.E, key.N))
-						if err != nil {
-							break
-						}
-					}
-					nBytes, err := base64.RawURLEncoding.DecodeString(key.N)
-					if err != nil {
-						break
-					}
-					eBytes, err := base64.RawURLEncoding.DecodeString(key.E)
-					if err != nil {
-						break
-					}
-					jwtPlugin.keys[key.Kid] = &rsa.PublicKey{N: new(big.Int).SetBytes(nBytes), E: int(new(big.Int).SetBytes(eBytes).Uint64())}
-				}
-			case "EC":
-				{
-					if key.Kid == "" {
-						key.Kid, err = JWKThumbprint(fmt.Sprintf(`{"crv":"P-256","kty":"EC","x":"%s","y":"%s"}`, key.X, key.Y))
-						if err != nil {
-							break
-						}
-					}
-					var crv elliptic.Curve
-					switch key.Crv {
-					case "P-256":
-						crv = elliptic.P256()
-					case "P-384":
-						crv = elliptic.P384()
-					case "P-521":
-						crv = elliptic.P521()
-					default:
-						switch key.Alg {
-						case "ES256":
-							crv = elliptic.P256()
-						case "ES384":
-							crv = elliptic.P384()
-						case "ES512":
-							crv = elliptic.P521()
-						default:
-							crv = elliptic.P256()
-						}
-					}
-					xBytes, err := base64.RawURLEncoding.DecodeString(key.X)
-					if err != nil {
-						break
-					}
-					yBytes, err := base64.RawURLEncoding.DecodeString(key.Y)
-					if err != nil {
-						break
-					}
-					jwtPlugin.keys[key.Kid] = &ecdsa.PublicKey{Curve: crv, X: new(big.Int).SetBytes(xBytes), Y: new(big.Int).SetBytes(yBytes)}
-				}
-			case "oct":
-				{
-					kBytes, err := base64.RawURLEncoding.DecodeString(key.K)
-					if err != nil {
-						break
-					}
-					if key.Kid == "" {
-						key.Kid, err = JWKThumbprint(key.K)
-						if err != nil {
-							break
-						}
-					}
-					jwtPlugin.keys[key.Kid] = kBytes
-				}
-			}
+		jtis = wrapped.Revoked
+	}
+	return stringSet(jtis), nil
+}
+
+// resolveConfig computes the effective settings from fields which have a legacy form, recording the provenance of
+// every value. A single migration report is logged when legacy fields are used.
+func (jwtPlugin *JwtPlugin) resolveConfig(config *Config) {
+	jwtPlugin.configReport = ConfigReport{Provenance: make(map[string]string)}
+	jwtPlugin.algs = jwtPlugin.resolveList("Algs", config.Algs, "Alg", config.Alg)
+	jwtPlugin.audiences = jwtPlugin.resolveList("Audiences", config.Audiences, "Aud", config.Aud)
+	jwtPlugin.headerMappings = jwtPlugin.resolveHeaderMappings(config.HeaderMappings, config.JwtHeaders)
+	for name := range config.JwksRequestHeaders {
+		if jwtPlugin.configReport.JwksRequestHeaders == nil {
+			jwtPlugin.configReport.JwksRequestHeaders = make(map[string]string)
+		}
+		jwtPlugin.configReport.JwksRequestHeaders[name] = "<redacted>"
+	}
+	for name := range config.OpaRequestHeaders {
+		if jwtPlugin.configReport.OpaRequestHeaders == nil {
+			jwtPlugin.configReport.OpaRequestHeaders = make(map[string]string)
 		}
+		jwtPlugin.configReport.OpaRequestHeaders[http.CanonicalHeaderKey(name)] = "<redacted>"
+	}
+	if config.OpaBearerToken != "" {
+		if jwtPlugin.configReport.OpaRequestHeaders == nil {
+			jwtPlugin.configReport.OpaRequestHeaders = make(map[string]string)
+		}
+		jwtPlugin.configReport.OpaRequestHeaders["Authorization"] = "<redacted>"
+	}
+	if len(jwtPlugin.configReport.Migrations) > 0 {
+		jsonLogEvent, _ := json.Marshal(&LogEvent{
+			Level:      "warning",
+			Msg:        "config migration report: legacy configuration fields in use",
+			Time:       jwtPlugin.now(),
+			Migrations: jwtPlugin.configReport.Migrations,
+		})
+		_, _ = fmt.Fprintln(jwtPlugin.logWriter, string(jsonLogEvent))
 	}
 }
 
-func (jwtPlugin *JwtPlugin) ServeHTTP(rw http.ResponseWriter, request *http.Request) {
-	if err := jwtPlugin.CheckToken(request); err != nil {
-		http.Error(rw, err.Error(), http.StatusForbidden)
-		return
+// resolveList resolves a list setting which replaced a single-valued legacy field
+func (jwtPlugin *JwtPlugin) resolveList(field string, value []string, legacyField string, legacyValue string) []string {
+	report := &jwtPlugin.configReport
+	if legacyValue != "" {
+		report.Migrations = append(report.Migrations, MigrationEntry{
+			Field:       legacyField,
+			Value:       legacyValue,
+			Replacement: fmt.Sprintf("%s: [%q]", field, legacyValue),
+			Ignored:     len(value) > 0,
+		})
 	}
-	jwtPlugin.next.ServeHTTP(rw, request)
+	switch {
+	case len(value) > 0:
+		report.Provenance[field] = field
+		return value
+	case legacyValue != "":
+		report.Provenance[field] = legacyField
+		return []string{legacyValue}
+	}
+	report.Provenance[field] = "default"
+	return nil
 }
 
-func (jwtPlugin *JwtPlugin) CheckToken(request *http.Request) error {
-	jwtToken, err := jwtPlugin.ExtractToken(request)
-	if err != nil {
-		return err
+// resolveHeaderMappings resolves the HeaderMappings, which replaced the JwtHeaders map. The mappings of the map are
+// sorted by header name.
+func (jwtPlugin *JwtPlugin) resolveHeaderMappings(mappings []HeaderMapping, legacy map[string]string) []HeaderMapping {
+	report := &jwtPlugin.configReport
+	var legacyMappings []HeaderMapping
+	if len(legacy) > 0 {
+		headers := make([]string, 0, len(legacy))
+		for header := range legacy {
+			headers = append(headers, header)
+		}
+		sort.Strings(headers)
+		var replacements []string
+		for _, header := range headers {
+			legacyMappings = append(legacyMappings, HeaderMapping{Header: header, Claim: legacy[header]})
+			replacements = append(replacements, fmt.Sprintf("{Header: %q, Claim: %q}", header, legacy[header]))
+		}
+		value, _ := json.Marshal(legacy)
+		report.Migrations = append(report.Migrations, MigrationEntry{
+			Field:       "JwtHeaders",
+			Value:       string(value),
+			Replacement: fmt.Sprintf("HeaderMappings: [%s]", strings.Join(replacements, ", ")),
+			Ignored:     len(mappings) > 0,
+		})
 	}
-	if jwtToken != nil {
-		// only verify jwt tokens if keys are configured
-		if len(jwtPlugin.keys) > 0 || len(jwtPlugin.jwkEndpoints) > 0 {
-			if err = jwtPlugin.VerifyToken(jwtToken); err != nil {
-				return err
-			}
+	switch {
+	case len(mappings) > 0:
+		report.Provenance["HeaderMappings"] = "HeaderMappings"
+		return mappings
+	case len(legacyMappings) > 0:
+		report.Provenance["HeaderMappings"] = "JwtHeaders"
+		return legacyMappings
+	}
+	report.Provenance["HeaderMappings"] = "default"
+	return nil
+}
+
+// ConfigReport returns the provenance of the effective settings and the legacy configuration fields in use
+func (jwtPlugin *JwtPlugin) ConfigReport() ConfigReport {
+	return jwtPlugin.configReport
+}
+
+func (jwtPlugin *JwtPlugin) configureAlternativeAuth(config *Config) error {
+	switch config.AlternativeAuth {
+	case "":
+		return nil
+	case authMethodClientCert:
+		if len(config.ClientCert.CAs) == 0 {
+			return fmt.Errorf("AlternativeAuth clientCert requires at least one certificate authority in ClientCert.CAs")
 		}
-		for _, fieldName := range jwtPlugin.payloadFields {
-			if _, ok := jwtToken.Payload[fieldName]; !ok {
-				if jwtPlugin.required {
-					return fmt.Errorf("payload missing required field %s", fieldName)
-				} else {
-					sub := fmt.Sprint(jwtToken.Payload["sub"])
-					network := jwtPlugin.remoteAddr(request)
-					jsonLogEvent, _ := json.Marshal(&LogEvent{
-						Level:   "warning",
-						Msg:     fmt.Sprintf("Missing JWT field %s", fieldName),
-						Time:    time.Now(),
-						Sub:     sub,
-						Network: network,
-						URL:     request.URL.String(),
-					})
-					fmt.Println(string(jsonLogEvent))
-				}
+		jwtPlugin.clientCAs = x509.NewCertPool()
+		for _, ca := range config.ClientCert.CAs {
+			if !jwtPlugin.clientCAs.AppendCertsFromPEM([]byte(ca)) {
+				return fmt.Errorf("failed to parse a PEM certificate in ClientCert.CAs")
 			}
 		}
-		for k, v := range jwtPlugin.jwtHeaders {
-			value, ok := jwtToken.Payload[v]
-			if ok {
-				request.Header.Add(k, value.(string))
-			}
+		jwtPlugin.alternativeAuth = config.AlternativeAuth
+		jwtPlugin.clientSANs = config.ClientCert.SANs
+		jwtPlugin.trustCertHeader = config.ClientCert.TrustForwardedHeader
+		return nil
+	default:
+		return fmt.Errorf("unsupported AlternativeAuth %s, expecting clientCert", config.AlternativeAuth)
+	}
+}
+
+// jwksTransport creates the transport for fetching the JWKS endpoints, which uses the JwksProxyUrl and trusts the
+// JwksTlsCa or skips the certificate verification. The proxied traffic is not affected.
+func (jwtPlugin *JwtPlugin) jwksTransport(config *Config) (*http.Transport, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = &tls.Config{}
+	if config.JwksProxyUrl != "" {
+		proxyUrl, err := url.Parse(config.JwksProxyUrl)
+		if err != nil || (proxyUrl.Scheme != "http" && proxyUrl.Scheme != "https") || proxyUrl.Host == "" {
+			return nil, fmt.Errorf("invalid JwksProxyUrl, expecting an http or https URL")
+		}
+		transport.Proxy = http.ProxyURL(proxyUrl)
+	}
+	if config.JwksInsecureSkipVerify {
+		jsonLogEvent, _ := json.Marshal(&LogEvent{
+			Level: "warning",
+			Msg:   "JwksInsecureSkipVerify is enabled, the certificates of the JWKS endpoints are NOT verified. Do not use this in production",
+			Time:  time.Now(),
+		})
+		_, _ = fmt.Fprintln(jwtPlugin.logWriter, string(jsonLogEvent))
+		transport.TLSClientConfig.InsecureSkipVerify = true
+	}
+	if config.JwksTlsCa == "" {
+		return transport, nil
+	}
+	roots, err := tlsCaPool("JwksTlsCa", config.JwksTlsCa)
+	if err != nil {
+		return nil, err
+	}
+	transport.TLSClientConfig.RootCAs = roots
+	return transport, nil
+}
+
+// pemOptionPath returns the path of the file of a PEM option, or "" when the option is inline PEM
+func pemOptionPath(value string) string {
+	if strings.Contains(value, "-----BEGIN") {
+		return ""
+	}
+	return strings.TrimPrefix(value, "file://")
+}
+
+// readPemOption returns the PEM data of an option which is either inline PEM or the path of a file
+func readPemOption(name string, value string) ([]byte, error) {
+	path := pemOptionPath(value)
+	if path == "" {
+		return []byte(value), nil
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %v", name, err)
+	}
+	return data, nil
+}
+
+// tlsCaPool returns the system roots together with the certificate authorities of a PEM option
+func tlsCaPool(name string, value string) (*x509.CertPool, error) {
+	bundle, err := readPemOption(name, value)
+	if err != nil {
+		return nil, err
+	}
+	roots, err := x509.SystemCertPool()
+	if err != nil || roots == nil {
+		roots = x509.NewCertPool()
+	}
+	if !roots.AppendCertsFromPEM(bundle) {
+		return nil, fmt.Errorf("failed to parse a PEM certificate in %s", name)
+	}
+	return roots, nil
+}
+
+// opaTransport creates the transport of the OPA queries, which keeps connections alive, trusts the OpaTlsCa (or
+// skips the certificate verification) and presents the OpaClientCert. The JWKS TLS settings do not apply.
+func (jwtPlugin *JwtPlugin) opaTransport(config *Config) (*http.Transport, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.MaxIdleConns = 100
+	transport.MaxIdleConnsPerHost = 100
+	if config.OpaClientCert == "" && config.OpaClientKey == "" && config.OpaTlsCa == "" && !config.OpaInsecureSkipVerify {
+		return transport, nil
+	}
+	transport.TLSClientConfig = &tls.Config{}
+	if config.OpaInsecureSkipVerify {
+		jsonLogEvent, _ := json.Marshal(&LogEvent{
+			Level: "warning",
+			Msg:   "OpaInsecureSkipVerify is enabled, the certificate of OPA is NOT verified. Do not use this in production",
+			Time:  time.Now(),
+		})
+		_, _ = fmt.Fprintln(jwtPlugin.logWriter, string(jsonLogEvent))
+		transport.TLSClientConfig.InsecureSkipVerify = true
+	}
+	if config.OpaTlsCa != "" {
+		roots, err := tlsCaPool("OpaTlsCa", config.OpaTlsCa)
+		if err != nil {
+			return nil, err
+		}
+		transport.TLSClientConfig.RootCAs = roots
+	}
+	if config.OpaClientCert == "" && config.OpaClientKey == "" {
+		return transport, nil
+	}
+	if config.OpaClientKey == "" {
+		return nil, fmt.Errorf("OpaClientCert requires OpaClientKey")
+	}
+	if config.OpaClientCert == "" {
+		return nil, fmt.Errorf("OpaClientKey requires OpaClientCert")
+	}
+	certificate := &clientCertificate{certOption: config.OpaClientCert, keyOption: config.OpaClientKey, logWriter: jwtPlugin.logWriter}
+	if err := certificate.load(); err != nil {
+		return nil, err
+	}
+	transport.TLSClientConfig.GetClientCertificate = certificate.get
+	return transport, nil
+}
+
+// clientCertificate is the OpaClientCert and OpaClientKey pair, reloaded when one of their files changes. When the
+// changed files cannot be loaded, for instance while only one of them has been replaced, the previous certificate
+// is kept.
+type clientCertificate struct {
+	certOption  string
+	keyOption   string
+	logWriter   io.Writer
+	lock        sync.Mutex
+	certificate *tls.Certificate
+	// modified is the latest modification time of the files of the certificate
+	modified time.Time
+}
+
+// load reads and parses the certificate and its key
+func (c *clientCertificate) load() error {
+	modified := c.filesModified()
+	certPem, err := readPemOption("OpaClientCert", c.certOption)
+	if err != nil {
+		return err
+	}
+	keyPem, err := readPemOption("OpaClientKey", c.keyOption)
+	if err != nil {
+		return err
+	}
+	certificate, err := tls.X509KeyPair(certPem, keyPem)
+	if err != nil {
+		return fmt.Errorf("invalid OpaClientCert or OpaClientKey: %v", err)
+	}
+	c.certificate, c.modified = &certificate, modified
+	return nil
+}
+
+// filesModified returns the latest modification time of the files of the certificate
+func (c *clientCertificate) filesModified() time.Time {
+	var modified time.Time
+	for _, option := range []string{c.certOption, c.keyOption} {
+		if path := pemOptionPath(option); path != "" {
+			if info, err := os.Stat(path); err == nil && info.ModTime().After(modified) {
+				modified = info.ModTime()
+			}
+		}
+	}
+	return modified
+}
+
+// get returns the certificate for a TLS handshake, reloading it first when its files changed
+func (c *clientCertificate) get(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if !c.filesModified().Equal(c.modified) {
+		if err := c.load(); err != nil {
+			jsonLogEvent, _ := json.Marshal(&LogEvent{
+				Level: "warning",
+				Msg:   fmt.Sprintf("Keeping the previous OPA client certificate: %v", err),
+				Time:  time.Now(),
+			})
+			_, _ = fmt.Fprintln(c.logWriter, string(jsonLogEvent))
+		} else {
+			jsonLogEvent, _ := json.Marshal(&LogEvent{Level: "info", Msg: "Reloaded the OPA client certificate", Time: time.Now()})
+			_, _ = fmt.Fprintln(c.logWriter, string(jsonLogEvent))
+		}
+	}
+	return c.certificate, nil
+}
+
+// newIssuers creates the plugins verifying the tokens of the configured Issuers. A top-level Iss with Keys is
+// added as the first issuer.
+func newIssuers(ctx context.Context, config *Config, name string) ([]*JwtPlugin, error) {
+	issuerConfigs := config.Issuers
+	if config.Iss != "" || len(config.Keys) > 0 || len(config.KeysByKid) > 0 || len(config.Secrets) > 0 || config.OidcDiscovery {
+		issuerConfigs = append([]IssuerConfig{{Iss: config.Iss, Keys: config.Keys, KeysByKid: config.KeysByKid, Secrets: config.Secrets, OidcDiscovery: config.OidcDiscovery}}, issuerConfigs...)
+	}
+	var issuers []*JwtPlugin
+	for _, issuerConfig := range issuerConfigs {
+		if issuerConfig.Iss == "" {
+			return nil, fmt.Errorf("Issuers: an issuer requires Iss")
+		}
+		if len(issuerConfig.Keys) == 0 && len(issuerConfig.KeysByKid) == 0 && len(issuerConfig.Secrets) == 0 && !issuerConfig.OidcDiscovery {
+			return nil, fmt.Errorf("Issuers: issuer %s requires Keys, Secrets or OidcDiscovery", issuerConfig.Iss)
+		}
+		audiences := firstList(issuerConfig.Audiences, issuerConfig.Aud)
+		if len(audiences) == 0 {
+			audiences = firstList(config.Audiences, config.Aud)
+		}
+		handler, err := New(ctx, nil, &Config{
+			Keys:                   issuerConfig.Keys,
+			KeysByKid:              issuerConfig.KeysByKid,
+			Secrets:                issuerConfig.Secrets,
+			Iss:                    issuerConfig.Iss,
+			OidcDiscovery:          issuerConfig.OidcDiscovery,
+			Audiences:              audiences,
+			Algs:                   firstList(config.Algs, config.Alg),
+			KeyFileReloadInterval:  config.KeyFileReloadInterval,
+			KeyRetentionPeriod:     config.KeyRetentionPeriod,
+			StrictKeyRotation:      config.StrictKeyRotation,
+			StrictEcdsaSignatures:  config.StrictEcdsaSignatures,
+			PssSaltLength:          config.PssSaltLength,
+			AllowUnencodedPayload:  config.AllowUnencodedPayload,
+			StrictKid:              config.StrictKid,
+			UnknownKidCacheSize:    config.UnknownKidCacheSize,
+			UnknownKidCacheTTL:     config.UnknownKidCacheTTL,
+			KeyAlgMatch:            config.KeyAlgMatch,
+			MinRsaKeyBits:          config.MinRsaKeyBits,
+			MinRsaKeyBitsMode:      config.MinRsaKeyBitsMode,
+			RequireKid:             config.RequireKid,
+			JwksImportAllKeys:      config.JwksImportAllKeys,
+			JwksFetchTimeout:       config.JwksFetchTimeout,
+			JwksTlsCa:              config.JwksTlsCa,
+			JwksInsecureSkipVerify: config.JwksInsecureSkipVerify,
+			JwksProxyUrl:           config.JwksProxyUrl,
+			JwksRequestHeaders:     config.JwksRequestHeaders,
+			JwksFetchRetries:       config.JwksFetchRetries,
+			JwksRetryBackoff:       config.JwksRetryBackoff,
+			JwksStartupFailureMode: config.JwksStartupFailureMode,
+			LazyKeys:               config.LazyKeys,
+			JwksDuplicateKidMode:   config.JwksDuplicateKidMode,
+			JwksRefreshInterval:    config.JwksRefreshInterval,
+		}, name)
+		if err != nil {
+			for _, issuer := range issuers {
+				_ = issuer.Close()
+			}
+			return nil, fmt.Errorf("Issuers: issuer %s: %v", issuerConfig.Iss, err)
+		}
+		issuers = append(issuers, handler.(*JwtPlugin))
+	}
+	return issuers, nil
+}
+
+// firstList returns the list when it is set, otherwise the single value as a list
+func firstList(list []string, single string) []string {
+	if len(list) > 0 {
+		return list
+	}
+	if single != "" {
+		return []string{single}
+	}
+	return nil
+}
+
+// tokenIssuer returns the plugin of the first configured issuer matching the iss claim of the token, or the plugin
+// itself when no Issuers are configured.
+func (jwtPlugin *JwtPlugin) tokenIssuer(jwtToken *JWT) (*JwtPlugin, error) {
+	if len(jwtPlugin.issuers) == 0 {
+		return jwtPlugin, nil
+	}
+	iss, ok := jwtToken.Payload["iss"].(string)
+	if !ok {
+		return nil, fmt.Errorf("token is missing the iss claim")
+	}
+	for _, issuer := range jwtPlugin.issuers {
+		if issuer.CheckIssuer(jwtToken) == nil {
+			return issuer, nil
+		}
+	}
+	return nil, fmt.Errorf("token issuer %s is not configured", iss)
+}
+
+func (jwtPlugin *JwtPlugin) BackgroundRefresh() {
+	if len(jwtPlugin.jwkEndpoints) == 0 {
+		return
+	}
+	// when the initial fetch failed, keep retrying with backoff until all endpoints have been fetched
+	for backoff := jwtPlugin.retryBackoff; atomic.LoadInt32(&jwtPlugin.keysPending) == 1; backoff *= 2 {
+		if backoff > jwtPlugin.refreshInterval {
+			backoff = jwtPlugin.refreshInterval
+		}
+		if !jwtPlugin.sleep(backoff) {
+			return
+		}
+		jwtPlugin.setKeysPending(!jwtPlugin.fetchKeys(jwtPlugin.background))
+	}
+	for jwtPlugin.sleep(jwtPlugin.refreshDelay()) {
+		jwtPlugin.fetchKeys(jwtPlugin.background)
+	}
+}
+
+func (jwtPlugin *JwtPlugin) setKeysPending(pending bool) {
+	value := int32(0)
+	if pending {
+		value = 1
+	}
+	atomic.StoreInt32(&jwtPlugin.keysPending, value)
+}
+
+// sleep waits for the duration, and reports false when the plugin was closed in the meantime
+func (jwtPlugin *JwtPlugin) sleep(duration time.Duration) bool {
+	timer := time.NewTimer(duration)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-jwtPlugin.background.Done():
+		return false
+	}
+}
+
+// Close stops the background loops of the plugin and of its issuers, which refresh the JWKS keys, the revocation
+// list and the key files, and closes the idle connections of the JWKS and OPA clients.
+func (jwtPlugin *JwtPlugin) Close() error {
+	jwtPlugin.stop()
+	for _, issuer := range jwtPlugin.issuers {
+		_ = issuer.Close()
+	}
+	if jwtPlugin.jwksClient != nil {
+		jwtPlugin.jwksClient.CloseIdleConnections()
+	}
+	if jwtPlugin.opaClient != nil {
+		jwtPlugin.opaClient.CloseIdleConnections()
+	}
+	return nil
+}
+
+func (jwtPlugin *JwtPlugin) ParseKeys(certificates []string) error {
+	for _, certificate := range certificates {
+		certificate, err := resolveEnv(certificate)
+		if err != nil {
+			return err
+		}
+		if strings.HasPrefix(certificate, "file://") {
+			file := &keyFile{path: strings.TrimPrefix(certificate, "file://")}
+			keys, err := file.read()
+			if err != nil {
+				return fmt.Errorf("failed to read the key file %s: %v", file.path, err)
+			}
+			for kid, key := range keys {
+				if err := jwtPlugin.checkKeySize(kid, key); err != nil {
+					return err
+				}
+				jwtPlugin.keys.Put(kid, storedKey{key: key})
+				jwtPlugin.logKeyStoreEvent(LogEvent{Level: "info", Msg: fmt.Sprintf("Imported a PEM key from %s", file.path), Kid: kid, Source: file.path})
+			}
+			file.keys = keys
+			jwtPlugin.keyFiles = append(jwtPlugin.keyFiles, file)
+		} else if isStaticKey(certificate) {
+			staticKeys, err := parseStaticKey(certificate)
+			if err != nil {
+				return err
+			}
+			for _, staticKey := range staticKeys {
+				if err := jwtPlugin.checkKeySize(staticKey.kid, staticKey.key); err != nil {
+					return err
+				}
+				jwtPlugin.keys.Put(staticKey.kid, storedKey{key: staticKey.key, x5t: staticKey.x5t})
+				jwtPlugin.logKeyStoreEvent(LogEvent{Level: "info", Msg: "Imported a static key", Kid: staticKey.kid, Source: "configuration"})
+			}
+		} else if u, err := url.ParseRequestURI(certificate); err == nil {
+			jwtPlugin.jwkEndpoints = append(jwtPlugin.jwkEndpoints, u)
+		} else {
+			return fmt.Errorf("Invalid configuration, expecting a certificate, public key or JWK URL")
+		}
+	}
+
+	return nil
+}
+
+// resolveEnv replaces an "env:NAME" reference by the value of the environment variable. The error never contains
+// the value.
+func resolveEnv(value string) (string, error) {
+	if !strings.HasPrefix(value, "env:") {
+		return value, nil
+	}
+	name := strings.TrimPrefix(value, "env:")
+	resolved, ok := os.LookupEnv(name)
+	if !ok {
+		return "", fmt.Errorf("environment variable %s is not set", name)
+	}
+	return resolved, nil
+}
+
+// resolveSecret resolves an "env:NAME" reference like resolveEnv, and replaces a "file:PATH" reference by the
+// content of the file without its trailing newline. The error never contains the value.
+func resolveSecret(value string) (string, error) {
+	if !strings.HasPrefix(value, "file:") {
+		return resolveEnv(value)
+	}
+	data, err := ioutil.ReadFile(strings.TrimPrefix(value, "file:"))
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(data), "\r\n"), nil
+}
+
+// pemKey is a key from a PEM block. The kid of a certificate is its subject key id, other keys are identified by
+// their RFC 7638 thumbprint.
+type pemKey struct {
+	kid string
+	key interface{}
+	// x5t holds the certificate thumbprints of a certificate, see certificateThumbprints
+	x5t []string
+}
+
+// certificateThumbprints returns the x5t (SHA-1) and x5t#S256 (SHA-256) thumbprints of a DER certificate
+func certificateThumbprints(der []byte) []string {
+	sha1Sum := sha1.Sum(der)
+	sha256Sum := sha256.Sum256(der)
+	return []string{base64.RawURLEncoding.EncodeToString(sha1Sum[:]), base64.RawURLEncoding.EncodeToString(sha256Sum[:])}
+}
+
+// jwkCertificateThumbprints returns the x5t and x5t#S256 of a JWK, together with the thumbprints of its first x5c
+// certificate
+func jwkCertificateThumbprints(key Key) []string {
+	var thumbprints []string
+	for _, thumbprint := range []string{key.X5t, key.X5tS256} {
+		if thumbprint != "" {
+			thumbprints = append(thumbprints, thumbprint)
+		}
+	}
+	if len(key.X5c) > 0 {
+		if der, err := base64.StdEncoding.DecodeString(key.X5c[0]); err == nil {
+			thumbprints = append(thumbprints, certificateThumbprints(der)...)
+		}
+	}
+	return thumbprints
+}
+
+// publicKeyThumbprint returns the RFC 7638 thumbprint of an RSA, EC or Ed25519 public key
+func publicKeyThumbprint(key interface{}) (string, error) {
+	encode := base64.RawURLEncoding.EncodeToString
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		return JWKThumbprint(fmt.Sprintf(`{"e":"%s","kty":"RSA","n":"%s"}`, encode(big.NewInt(int64(k.E)).Bytes()), encode(k.N.Bytes())))
+	case *ecdsa.PublicKey:
+		size := (k.Curve.Params().BitSize + 7) / 8
+		x, y := make([]byte, size), make([]byte, size)
+		k.X.FillBytes(x)
+		k.Y.FillBytes(y)
+		return JWKThumbprint(fmt.Sprintf(`{"crv":"%s","kty":"EC","x":"%s","y":"%s"}`, k.Curve.Params().Name, encode(x), encode(y)))
+	case ed25519.PublicKey:
+		return JWKThumbprint(fmt.Sprintf(`{"crv":"Ed25519","kty":"OKP","x":"%s"}`, encode(k)))
+	}
+	return "", fmt.Errorf("unsupported public key type %T", key)
+}
+
+// ParseKeysByKid adds the certificates and public keys of KeysByKid under their configured kid. Of a PEM bundle,
+// only the first block is used, e.g. the leaf of a certificate chain.
+func (jwtPlugin *JwtPlugin) ParseKeysByKid(keys map[string]string) error {
+	for kid, value := range keys {
+		if _, ok := jwtPlugin.keys.Get(kid); ok {
+			return fmt.Errorf("KeysByKid %s: duplicate kid", kid)
+		}
+		value, err := resolveEnv(value)
+		if err != nil {
+			return fmt.Errorf("KeysByKid %s: %v", kid, err)
+		}
+		if strings.HasPrefix(value, "file://") {
+			file := &keyFile{path: strings.TrimPrefix(value, "file://"), kid: kid}
+			if file.keys, err = file.read(); err != nil {
+				return fmt.Errorf("KeysByKid %s: failed to read the key file %s: %v", kid, file.path, err)
+			}
+			if err := jwtPlugin.checkKeySize(kid, file.keys[kid]); err != nil {
+				return err
+			}
+			jwtPlugin.keys.Put(kid, storedKey{key: file.keys[kid]})
+			jwtPlugin.keyFiles = append(jwtPlugin.keyFiles, file)
+			jwtPlugin.logKeyStoreEvent(LogEvent{Level: "info", Msg: fmt.Sprintf("Imported a PEM key from %s", file.path), Kid: kid, Source: file.path})
+			continue
+		}
+		if !isStaticKey(value) {
+			return fmt.Errorf("KeysByKid %s: expecting a certificate or public key", kid)
+		}
+		staticKeys, err := parseStaticKey(value)
+		if err != nil {
+			return fmt.Errorf("KeysByKid %s: %v", kid, err)
+		}
+		if err := jwtPlugin.checkKeySize(kid, staticKeys[0].key); err != nil {
+			return err
+		}
+		jwtPlugin.keys.Put(kid, storedKey{key: staticKeys[0].key})
+		jwtPlugin.logKeyStoreEvent(LogEvent{Level: "info", Msg: "Imported a static key", Kid: kid, Source: "configuration"})
+	}
+	return nil
+}
+
+// isStaticKey reports whether a Keys entry is a PEM bundle or a der: public key
+func isStaticKey(value string) bool {
+	block, _ := pem.Decode([]byte(value))
+	return block != nil || strings.HasPrefix(value, "der:")
+}
+
+// parseStaticKey parses a PEM bundle or a der: public key
+func parseStaticKey(value string) ([]pemKey, error) {
+	if strings.HasPrefix(value, "der:") {
+		kid, key, err := parseDerPublicKey(strings.TrimPrefix(value, "der:"))
+		if err != nil {
+			return nil, err
+		}
+		return []pemKey{{kid: kid, key: key}}, nil
+	}
+	return parsePem([]byte(value))
+}
+
+// parseDerPublicKey parses a base64 encoded DER SubjectPublicKeyInfo, returning its thumbprint and the public key
+func parseDerPublicKey(encoded string) (string, interface{}, error) {
+	encoded = strings.Join(strings.Fields(encoded), "")
+	der, err := base64.RawStdEncoding.DecodeString(strings.TrimRight(encoded, "="))
+	if err != nil {
+		return "", nil, fmt.Errorf("invalid base64 in a der: key: %v", err)
+	}
+	key, err := x509.ParsePKIXPublicKey(der)
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to parse a DER public key: %v", err)
+	}
+	key = publicKeyPointer(key)
+	kid, err := publicKeyThumbprint(key)
+	if err != nil {
+		return "", nil, err
+	}
+	return kid, key, nil
+}
+
+// parsePem parses every CERTIFICATE and PUBLIC KEY block of a PEM bundle, e.g. a certificate chain. Whitespace
+// between and after the blocks is ignored, other trailing data is an error.
+func parsePem(data []byte) ([]pemKey, error) {
+	var keys []pemKey
+	for rest := data; len(keys) == 0 || len(bytes.TrimSpace(rest)) > 0; {
+		if len(keys) > 0 && !bytes.HasPrefix(bytes.TrimSpace(rest), []byte("-----BEGIN")) {
+			return nil, fmt.Errorf("extra data after a PEM certificate block")
+		}
+		var block *pem.Block
+		if block, rest = pem.Decode(rest); block == nil {
+			if len(keys) == 0 {
+				return nil, fmt.Errorf("no PEM block found")
+			}
+			return nil, fmt.Errorf("extra data after a PEM certificate block")
+		}
+		switch block.Type {
+		case "CERTIFICATE":
+			cert, err := x509.ParseCertificate(block.Bytes)
+			if err != nil {
+				return nil, fmt.Errorf("failed to parse a PEM certificate: %v", err)
+			}
+			kid := base64.RawURLEncoding.EncodeToString(cert.SubjectKeyId)
+			if kid == "" {
+				if kid, err = publicKeyThumbprint(cert.PublicKey); err != nil {
+					return nil, err
+				}
+			}
+			keys = append(keys, pemKey{kid: kid, key: publicKeyPointer(cert.PublicKey), x5t: certificateThumbprints(cert.Raw)})
+		case "PUBLIC KEY", "RSA PUBLIC KEY":
+			key, err := x509.ParsePKIXPublicKey(block.Bytes)
+			if err != nil {
+				return nil, fmt.Errorf("failed to parse a PEM public key: %v", err)
+			}
+			kid, err := publicKeyThumbprint(key)
+			if err != nil {
+				return nil, err
+			}
+			keys = append(keys, pemKey{kid: kid, key: publicKeyPointer(key)})
+		default:
+			return nil, fmt.Errorf("failed to extract a Key from the PEM certificate")
+		}
+	}
+	return keys, nil
+}
+
+// keyFile is a PEM bundle in a local file. With a kid, only the first block is used and registered under the kid.
+type keyFile struct {
+	path string
+	kid  string
+	keys map[string]interface{}
+}
+
+func (file *keyFile) read() (map[string]interface{}, error) {
+	data, err := ioutil.ReadFile(file.path)
+	if err != nil {
+		return nil, err
+	}
+	pemKeys, err := parsePem(data)
+	if err != nil {
+		return nil, err
+	}
+	if file.kid != "" {
+		return map[string]interface{}{file.kid: pemKeys[0].key}, nil
+	}
+	keys := make(map[string]interface{})
+	for _, pemKey := range pemKeys {
+		keys[pemKey.kid] = pemKey.key
+	}
+	return keys, nil
+}
+
+func (jwtPlugin *JwtPlugin) configureKeyFiles(config *Config) error {
+	if len(jwtPlugin.keyFiles) == 0 {
+		return nil
+	}
+	jwtPlugin.keyFileInterval = time.Minute
+	if config.KeyFileReloadInterval != "" {
+		interval, err := time.ParseDuration(config.KeyFileReloadInterval)
+		if err != nil || interval <= 0 {
+			return fmt.Errorf("invalid KeyFileReloadInterval: %s", config.KeyFileReloadInterval)
+		}
+		jwtPlugin.keyFileInterval = interval
+	}
+	go func() {
+		for jwtPlugin.sleep(jwtPlugin.keyFileInterval) {
+			jwtPlugin.ReloadKeyFiles()
+		}
+	}()
+	return nil
+}
+
+// ReloadKeyFiles re-reads the keys from local files. When a file cannot be read, the previous keys are kept.
+func (jwtPlugin *JwtPlugin) ReloadKeyFiles() {
+	for _, file := range jwtPlugin.keyFiles {
+		keys, err := file.read()
+		for kid, key := range keys {
+			if err == nil {
+				err = jwtPlugin.checkKeySize(kid, key)
+			}
+		}
+		if err != nil {
+			jwtPlugin.logKeyStoreEvent(LogEvent{Level: "warning", Msg: fmt.Sprintf("Failed to reload the key file %s, keeping the previous keys: %v", file.path, err), Source: file.path})
+			continue
+		}
+		if keySetsEqual(file.keys, keys) {
+			continue
+		}
+		previous := file.keys
+		jwtPlugin.keys.Update(func(stored map[string]storedKey) {
+			for kid := range previous {
+				delete(stored, kid)
+			}
+			for kid, key := range keys {
+				stored[kid] = storedKey{key: key}
+			}
+		})
+		file.keys = keys
+		jwtPlugin.logKeyStoreEvent(LogEvent{Level: "info", Msg: fmt.Sprintf("Key file %s reloaded, %d keys", file.path, len(keys)), Source: file.path, KeyCount: keyCount(len(keys))})
+	}
+}
+
+// ParseSecrets adds the configured shared secrets to the keys under their kid. A "base64:" value is decoded
+// (standard or URL-safe alphabet, padding optional), a "plain:" value is used as is. The value after the prefix
+// may be an "env:NAME" reference, a bare "env:NAME" is a plain secret.
+func (jwtPlugin *JwtPlugin) ParseSecrets(secrets map[string]string) error {
+	for kid, secret := range secrets {
+		if _, ok := jwtPlugin.keys.Get(kid); ok {
+			return fmt.Errorf("secret %s: duplicate kid", kid)
+		}
+		var encoding string
+		if strings.HasPrefix(secret, "plain:") || strings.HasPrefix(secret, "base64:") {
+			encoding = secret[:strings.Index(secret, ":")]
+			secret = secret[len(encoding)+1:]
+		} else if strings.HasPrefix(secret, "env:") {
+			encoding = "plain"
+		} else {
+			return fmt.Errorf("secret %s: expecting a base64:, plain: or env: prefix", kid)
+		}
+		secret, err := resolveEnv(secret)
+		if err != nil {
+			return fmt.Errorf("secret %s: %v", kid, err)
+		}
+		key := []byte(secret)
+		if encoding == "base64" {
+			encoded := strings.TrimRight(secret, "=")
+			if strings.ContainsAny(encoded, "-_") {
+				key, err = base64.RawURLEncoding.DecodeString(encoded)
+			} else {
+				key, err = base64.RawStdEncoding.DecodeString(encoded)
+			}
+			if err != nil {
+				return fmt.Errorf("secret %s: invalid base64: %v", kid, err)
+			}
+		}
+		if len(key) == 0 {
+			return fmt.Errorf("secret %s: empty secret", kid)
+		}
+		jwtPlugin.keys.Put(kid, storedKey{key: key})
+		jwtPlugin.logKeyStoreEvent(LogEvent{Level: "info", Msg: "Imported a shared secret", Kid: kid, Source: "configuration"})
+	}
+	return nil
+}
+
+// openIDConfiguration contains the fields of the OpenID provider configuration used by the plugin
+type openIDConfiguration struct {
+	Issuer  string `json:"issuer"`
+	JwksURI string `json:"jwks_uri"`
+}
+
+// discoverJwksUri fetches the OpenID configuration of the issuer and returns its jwks_uri. The issuer in the
+// configuration must match the configured issuer.
+func (jwtPlugin *JwtPlugin) discoverJwksUri(ctx context.Context, iss string) (*url.URL, error) {
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimSuffix(iss, "/")+"/.well-known/openid-configuration", nil)
+	if err != nil {
+		return nil, err
+	}
+	response, err := jwtPlugin.jwksClient.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %d", response.StatusCode)
+	}
+	var configuration openIDConfiguration
+	if err := json.NewDecoder(response.Body).Decode(&configuration); err != nil {
+		return nil, fmt.Errorf("invalid OpenID configuration: %v", err)
+	}
+	if configuration.Issuer != iss {
+		return nil, fmt.Errorf("OpenID configuration has issuer %s", configuration.Issuer)
+	}
+	if configuration.JwksURI == "" {
+		return nil, fmt.Errorf("OpenID configuration has no jwks_uri")
+	}
+	return url.ParseRequestURI(configuration.JwksURI)
+}
+
+// FetchKeys fetches the keys from the JWKS endpoints
+func (jwtPlugin *JwtPlugin) FetchKeys() {
+	jwtPlugin.fetchKeys(context.Background())
+}
+
+// fetchKeysWithRetry fetches the keys, retrying with exponential backoff. It reports whether all endpoints were
+// fetched.
+func (jwtPlugin *JwtPlugin) fetchKeysWithRetry(ctx context.Context) bool {
+	backoff := jwtPlugin.retryBackoff
+	for attempt := 0; ; attempt++ {
+		if jwtPlugin.fetchKeys(ctx) {
+			return true
+		}
+		if attempt >= jwtPlugin.fetchRetries {
+			return false
+		}
+		select {
+		case <-ctx.Done():
+			return false
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+// fetchKeys fetches the keys from all JWKS endpoints, reporting whether all of them were fetched
+func (jwtPlugin *JwtPlugin) fetchKeys(ctx context.Context) bool {
+	if len(jwtPlugin.jwkEndpoints) == 0 {
+		return true
+	}
+	jwtPlugin.fetchLock.Lock()
+	defer jwtPlugin.fetchLock.Unlock()
+	fetched := make(map[string]interface{})
+	sources := make(map[string]string)
+	algs := make(map[string]string)
+	x5ts := make(map[string][]string)
+	failures := make(map[string]string)
+	// the next refresh honours the shortest Cache-Control max-age of the responses
+	var maxAge time.Duration
+	for _, u := range jwtPlugin.jwkEndpoints {
+		response, err := jwtPlugin.fetchJwks(ctx, u)
+		if err != nil {
+			failures[u.String()] = err.Error()
+			jwtPlugin.logKeyStoreEvent(LogEvent{Level: "error", Msg: fmt.Sprintf("Failed to fetch JWKS from %s: %v", u, err), Source: u.String()})
+			continue
+		}
+		if kid, source := jwtPlugin.duplicateKid(response.keys, fetched, sources); kid != "" && jwtPlugin.duplicateKidError {
+			failures[u.String()] = fmt.Sprintf("duplicate kid, also published by %s", source)
+			jwtPlugin.logKeyStoreEvent(LogEvent{Level: "error", Msg: fmt.Sprintf("Rejecting JWKS from %s: duplicate kid, also published by %s", u, source), Kid: kid, Source: u.String()})
+			continue
+		}
+		for kid, key := range response.keys {
+			if source, ok := jwtPlugin.kidSource(kid, sources); ok {
+				if !keysEqual(fetched[kid], key) {
+					jwtPlugin.logKeyStoreEvent(LogEvent{Level: "warning", Msg: fmt.Sprintf("Ignoring JWKS key from %s: duplicate kid, also published by %s", u, source), Kid: kid, Source: u.String()})
+				}
+				continue
+			}
+			fetched[kid] = key
+			sources[kid] = u.String()
+			if alg, ok := response.algs[kid]; ok {
+				algs[kid] = alg
+			}
+			if x5t, ok := response.x5ts[kid]; ok {
+				x5ts[kid] = x5t
+			}
+		}
+		if response.maxAge > 0 && (maxAge == 0 || response.maxAge < maxAge) {
+			maxAge = response.maxAge
+		}
+	}
+	jwtPlugin.nextRefresh = jwtPlugin.refreshInterval
+	if maxAge > 0 {
+		jwtPlugin.nextRefresh = jwtPlugin.clampMaxAge(maxAge)
+	}
+	complete := len(failures) == 0
+	jwtPlugin.mergeKeys(fetched, sources, algs, x5ts, failures)
+	jwtPlugin.jwksErrorsLock.Lock()
+	jwtPlugin.jwksErrors = failures
+	jwtPlugin.jwksErrorsLock.Unlock()
+	count := keyCount(len(jwtPlugin.keys.All()))
+	if complete {
+		jwtPlugin.logKeyStoreEvent(LogEvent{Level: "info", Msg: fmt.Sprintf("JWKS refreshed, %d current keys fetched, %d retired keys retained", len(fetched), len(jwtPlugin.retiredKeys)), KeyCount: count})
+	} else {
+		jwtPlugin.logKeyStoreEvent(LogEvent{Level: "warning", Msg: "JWKS refresh failed for some endpoints, keeping the previously fetched keys", KeyCount: count})
+	}
+	return complete
+}
+
+// loadLazyKeys loads the keys of the LazyKeys mode on the first request with a token and starts the background
+// refresh. Concurrent requests wait for the same fetch, and after a failure the next attempt is only made after the
+// JwksRetryBackoff, so requests are rejected without contacting the endpoints in the meantime.
+func (jwtPlugin *JwtPlugin) loadLazyKeys() error {
+	if !jwtPlugin.lazyKeys || atomic.LoadInt32(&jwtPlugin.lazyLoaded) == 1 {
+		return nil
+	}
+	jwtPlugin.lazyLock.Lock()
+	defer jwtPlugin.lazyLock.Unlock()
+	if atomic.LoadInt32(&jwtPlugin.lazyLoaded) == 1 {
+		return nil
+	}
+	now := jwtPlugin.now()
+	if now.Before(jwtPlugin.lazyRetry) {
+		return fmt.Errorf("no keys available yet to verify the token")
+	}
+	jwtPlugin.lazyRetry = now.Add(jwtPlugin.retryBackoff)
+	if jwtPlugin.lazyDiscovery != "" {
+		jwksUri, err := jwtPlugin.discoverJwksUri(context.Background(), jwtPlugin.lazyDiscovery)
+		if err != nil {
+			jwtPlugin.logKeyEvent("error", fmt.Sprintf("OIDC discovery for issuer %s failed: %v", jwtPlugin.lazyDiscovery, err), "")
+			return fmt.Errorf("no keys available yet to verify the token")
+		}
+		jwtPlugin.jwkEndpoints = append(jwtPlugin.jwkEndpoints, jwksUri)
+		jwtPlugin.lazyDiscovery = ""
+	}
+	complete := jwtPlugin.fetchKeys(context.Background())
+	if !jwtPlugin.hasKeys() {
+		return fmt.Errorf("no keys available yet to verify the token")
+	}
+	jwtPlugin.setKeysPending(!complete)
+	atomic.StoreInt32(&jwtPlugin.lazyLoaded, 1)
+	go jwtPlugin.BackgroundRefresh()
+	return nil
+}
+
+// refreshDelay returns the delay until the next JWKS refresh
+func (jwtPlugin *JwtPlugin) refreshDelay() time.Duration {
+	jwtPlugin.fetchLock.Lock()
+	defer jwtPlugin.fetchLock.Unlock()
+	return jwtPlugin.nextRefresh
+}
+
+// parseX5c returns the public key of the leaf certificate of the x5c chain. Keys without kid are registered under
+// the SHA-256 thumbprint of the certificate.
+func parseX5c(key Key) (string, interface{}, error) {
+	der, err := base64.StdEncoding.DecodeString(key.X5c[0])
+	if err != nil {
+		return key.Kid, nil, fmt.Errorf("invalid x5c certificate: %v", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return key.Kid, nil, fmt.Errorf("invalid x5c certificate: %v", err)
+	}
+	switch cert.PublicKey.(type) {
+	case *rsa.PublicKey:
+		if key.Kty != "RSA" {
+			return key.Kid, nil, fmt.Errorf("x5c certificate has an RSA key, expected %s", key.Kty)
+		}
+	case *ecdsa.PublicKey:
+		if key.Kty != "EC" {
+			return key.Kid, nil, fmt.Errorf("x5c certificate has an EC key, expected %s", key.Kty)
+		}
+	default:
+		return key.Kid, nil, fmt.Errorf("unsupported x5c certificate key type")
+	}
+	kid := key.Kid
+	if kid == "" {
+		thumbprint := sha256.Sum256(cert.Raw)
+		kid = base64.RawURLEncoding.EncodeToString(thumbprint[:])
+	}
+	return kid, cert.PublicKey, nil
+}
+
+// JwksErrors returns the errors of the last JWKS fetch by endpoint URL
+func (jwtPlugin *JwtPlugin) JwksErrors() map[string]string {
+	jwtPlugin.jwksErrorsLock.Lock()
+	defer jwtPlugin.jwksErrorsLock.Unlock()
+	errors := make(map[string]string, len(jwtPlugin.jwksErrors))
+	for u, err := range jwtPlugin.jwksErrors {
+		errors[u] = err
+	}
+	return errors
+}
+
+// parseJwksDocument returns the keys of a JWKS document. Besides the standard {"keys":[...]} document, a bare array
+// of JWKs, a single JWK and an object of kid to PEM certificate (as published by Firebase) are accepted. The
+// certificates are returned by kid.
+func parseJwksDocument(body []byte) ([]Key, map[string]string, error) {
+	if bytes.HasPrefix(bytes.TrimSpace(body), []byte("[")) {
+		var keys []Key
+		err := json.Unmarshal(body, &keys)
+		return keys, nil, err
+	}
+	var document map[string]json.RawMessage
+	if err := json.Unmarshal(body, &document); err != nil {
+		return nil, nil, err
+	}
+	if _, ok := document["keys"]; ok {
+		var jwks Keys
+		err := json.Unmarshal(body, &jwks)
+		return jwks.Keys, nil, err
+	}
+	if _, ok := document["kty"]; ok {
+		var key Key
+		err := json.Unmarshal(body, &key)
+		return []Key{key}, nil, err
+	}
+	certificates := make(map[string]string, len(document))
+	for kid, value := range document {
+		var certificate string
+		if json.Unmarshal(value, &certificate) != nil || !strings.HasPrefix(strings.TrimSpace(certificate), "-----BEGIN") {
+			return nil, nil, fmt.Errorf("expecting a keys array, a JWK or an object of kid to PEM certificate")
+		}
+		certificates[kid] = certificate
+	}
+	return nil, certificates, nil
+}
+
+// jwksResponse holds the parsed keys of a JWKS endpoint together with the response metadata used for refreshing
+type jwksResponse struct {
+	keys map[string]interface{}
+	// algs holds the alg declared by the keys which have one
+	algs map[string]string
+	// x5ts holds the certificate thumbprints of the keys which have a certificate
+	x5ts   map[string][]string
+	etag   string
+	maxAge time.Duration
+}
+
+// fetchJwks fetches and parses the keys of a JWKS endpoint. Keys which cannot be used are skipped with a warning,
+// an endpoint without any usable key is an error. The ETag of the previous response is sent as If-None-Match, so a
+// 304 response reuses the previously parsed keys.
+func (jwtPlugin *JwtPlugin) fetchJwks(ctx context.Context, u *url.URL) (jwksResponse, error) {
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return jwksResponse{}, err
+	}
+	for name, value := range jwtPlugin.jwksHeaders {
+		request.Header.Set(name, value)
+	}
+	cached, isCached := jwtPlugin.jwksCache[u.String()]
+	if isCached && cached.etag != "" {
+		request.Header.Set("If-None-Match", cached.etag)
+	}
+	response, err := jwtPlugin.jwksClient.Do(request)
+	if err != nil {
+		return jwksResponse{}, err
+	}
+	defer response.Body.Close()
+	maxAge := cacheMaxAge(response.Header.Get("Cache-Control"))
+	if response.StatusCode == http.StatusNotModified && isCached {
+		cached.maxAge = maxAge
+		jwtPlugin.jwksCache[u.String()] = cached
+		return cached, nil
+	}
+	if response.StatusCode != http.StatusOK {
+		return jwksResponse{}, fmt.Errorf("unexpected status %d", response.StatusCode)
+	}
+	body, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return jwksResponse{}, err
+	}
+	jwks, certificates, err := parseJwksDocument(body)
+	if err != nil {
+		return jwksResponse{}, fmt.Errorf("invalid JWKS: %v", err)
+	}
+	keys := make(map[string]interface{})
+	algs := make(map[string]string)
+	x5ts := make(map[string][]string)
+	skipped := 0
+	for kid, certificate := range certificates {
+		pemKeys, err := parsePem([]byte(certificate))
+		if err == nil {
+			err = jwtPlugin.checkKeySize(kid, pemKeys[0].key)
+		}
+		if err != nil {
+			jwtPlugin.logKeyStoreEvent(LogEvent{Level: "warning", Msg: fmt.Sprintf("Skipping JWKS key from %s: %v", u, err), Kid: kid, Source: u.String()})
+			skipped++
+			continue
+		}
+		keys[kid] = publicKeyPointer(pemKeys[0].key)
+		x5ts[kid] = pemKeys[0].x5t
+	}
+	for _, jwk := range jwks {
+		if !jwtPlugin.importAllKeys && !isSigningKey(jwk) {
+			skipped++
+			continue
+		}
+		kid, key, err := parseJwk(jwk)
+		if err == nil {
+			err = jwtPlugin.checkKeySize(kid, key)
+		}
+		if err != nil {
+			jwtPlugin.logKeyStoreEvent(LogEvent{Level: "warning", Msg: fmt.Sprintf("Skipping JWKS key from %s: %v", u, err), Kid: jwk.Kid, Alg: jwk.Alg, Source: u.String()})
+			skipped++
+			continue
+		}
+		if jwk.Kid == "" {
+			jwtPlugin.logKeyStoreEvent(LogEvent{Level: "info", Msg: fmt.Sprintf("Derived kid %s from the thumbprint of a JWKS key from %s without kid", kid, u), Kid: kid, Alg: jwk.Alg, Source: u.String()})
+		}
+		keys[kid] = publicKeyPointer(key)
+		if jwk.Alg != "" {
+			algs[kid] = jwk.Alg
+		}
+		if x5t := jwkCertificateThumbprints(jwk); len(x5t) > 0 {
+			x5ts[kid] = x5t
+		}
+	}
+	jwtPlugin.logKeyStoreEvent(LogEvent{Level: "info", Msg: fmt.Sprintf("Imported %d JWKS keys from %s, skipped %d", len(keys), u, skipped), Source: u.String(), KeyCount: keyCount(len(keys))})
+	if len(keys) == 0 {
+		return jwksResponse{}, fmt.Errorf("no usable keys")
+	}
+	fetched := jwksResponse{keys: keys, algs: algs, x5ts: x5ts, etag: response.Header.Get("ETag"), maxAge: maxAge}
+	jwtPlugin.jwksCache[u.String()] = fetched
+	return fetched, nil
+}
+
+// minJwksMaxAge and maxJwksMaxAge bound the refresh delay taken from a Cache-Control max-age, so that an IdP cannot
+// make every instance re-fetch its JWKS every second, or never again
+const (
+	minJwksMaxAge = time.Minute
+	maxJwksMaxAge = 24 * time.Hour
+)
+
+// clampMaxAge bounds a max-age to [minJwksMaxAge, maxJwksMaxAge]. A JwksRefreshInterval below minJwksMaxAge
+// lowers the minimum to the interval.
+func (jwtPlugin *JwtPlugin) clampMaxAge(maxAge time.Duration) time.Duration {
+	minimum := minJwksMaxAge
+	if jwtPlugin.refreshInterval < minimum {
+		minimum = jwtPlugin.refreshInterval
+	}
+	if maxAge < minimum {
+		return minimum
+	}
+	if maxAge > maxJwksMaxAge {
+		return maxJwksMaxAge
+	}
+	return maxAge
+}
+
+// cacheMaxAge returns the max-age directive of a Cache-Control header, or 0 when it is absent
+func cacheMaxAge(cacheControl string) time.Duration {
+	for _, directive := range strings.Split(cacheControl, ",") {
+		directive = strings.ToLower(strings.TrimSpace(directive))
+		if strings.HasPrefix(directive, "max-age=") {
+			seconds, err := strconv.Atoi(strings.Trim(directive[len("max-age="):], `"`))
+			if err == nil && seconds > 0 {
+				return time.Duration(seconds) * time.Second
+			}
+		}
+	}
+	return 0
+}
+
+// isSigningKey reports whether a JSON web key may be used to verify signatures. Keys without use and key_ops are
+// assumed to be signing keys.
+func isSigningKey(key Key) bool {
+	if key.Use != "" && key.Use != "sig" {
+		return false
+	}
+	return key.KeyOps == nil || containsString(key.KeyOps, "verify")
+}
+
+// parseJwk converts a JSON web key, returning its kid (the thumbprint when the key has no kid) and public key.
+// RSA and EC keys without explicit key material use the public key of the first x5c certificate.
+func parseJwk(key Key) (string, interface{}, error) {
+	var err error
+	if len(key.X5c) > 0 && (key.Kty == "RSA" && (key.N == "" || key.E == "") || key.Kty == "EC" && (key.X == "" || key.Y == "")) {
+		return parseX5c(key)
+	}
+	switch key.Kty {
+	case "RSA":
+		if key.Kid == "" {
+			if key.Kid, err = JWKThumbprint(fmt.Sprintf(`{"e":"%s","kty":"RSA","n":"%s"}`, key.E, key.N)); err != nil {
+				return "", nil, err
+			}
+		}
+		nBytes, err := base64.RawURLEncoding.DecodeString(key.N)
+		if err != nil {
+			return key.Kid, nil, fmt.Errorf("invalid RSA modulus: %v", err)
+		}
+		eBytes, err := base64.RawURLEncoding.DecodeString(key.E)
+		if err != nil {
+			return key.Kid, nil, fmt.Errorf("invalid RSA exponent: %v", err)
+		}
+		return key.Kid, &rsa.PublicKey{N: new(big.Int).SetBytes(nBytes), E: int(new(big.Int).SetBytes(eBytes).Uint64())}, nil
+	case "EC":
+		crv, name, err := jwkCurve(key)
+		if err != nil {
+			return key.Kid, nil, err
+		}
+		if key.Kid == "" {
+			if key.Kid, err = JWKThumbprint(fmt.Sprintf(`{"crv":"%s","kty":"EC","x":"%s","y":"%s"}`, name, key.X, key.Y)); err != nil {
+				return "", nil, err
+			}
+		}
+		xBytes, err := base64.RawURLEncoding.DecodeString(key.X)
+		if err != nil {
+			return key.Kid, nil, fmt.Errorf("invalid EC x coordinate: %v", err)
+		}
+		yBytes, err := base64.RawURLEncoding.DecodeString(key.Y)
+		if err != nil {
+			return key.Kid, nil, fmt.Errorf("invalid EC y coordinate: %v", err)
+		}
+		publicKey := &ecdsa.PublicKey{Curve: crv, X: new(big.Int).SetBytes(xBytes), Y: new(big.Int).SetBytes(yBytes)}
+		if !crv.IsOnCurve(publicKey.X, publicKey.Y) {
+			return key.Kid, nil, fmt.Errorf("EC point is not on curve %s", name)
+		}
+		return key.Kid, publicKey, nil
+	case "OKP":
+		if key.Crv != "Ed25519" {
+			return key.Kid, nil, fmt.Errorf("unsupported OKP curve %q", key.Crv)
+		}
+		xBytes, err := base64.RawURLEncoding.DecodeString(key.X)
+		if err != nil {
+			return key.Kid, nil, fmt.Errorf("invalid OKP public key: %v", err)
+		}
+		if len(xBytes) != ed25519.PublicKeySize {
+			return key.Kid, nil, fmt.Errorf("invalid Ed25519 public key length %d", len(xBytes))
+		}
+		if key.Kid == "" {
+			if key.Kid, err = JWKThumbprint(fmt.Sprintf(`{"crv":"Ed25519","kty":"OKP","x":"%s"}`, key.X)); err != nil {
+				return "", nil, err
+			}
+		}
+		return key.Kid, ed25519.PublicKey(xBytes), nil
+	case "oct":
+		kBytes, err := base64.RawURLEncoding.DecodeString(key.K)
+		if err != nil {
+			return key.Kid, nil, fmt.Errorf("invalid symmetric key: %v", err)
+		}
+		if key.Kid == "" {
+			if key.Kid, err = JWKThumbprint(fmt.Sprintf(`{"k":"%s","kty":"oct"}`, key.K)); err != nil {
+				return "", nil, err
+			}
+		}
+		return key.Kid, kBytes, nil
+	}
+	return key.Kid, nil, fmt.Errorf("unsupported key type %s", key.Kty)
+}
+
+// ecCurves maps the RFC 7518 crv names, and the SEC 2 and OpenSSL names some issuers publish instead, to the
+// RFC 7518 name of the curve.
+var ecCurves = map[string]string{
+	"P-256":      "P-256",
+	"P256":       "P-256",
+	"secp256r1":  "P-256",
+	"prime256v1": "P-256",
+	"P-384":      "P-384",
+	"P384":       "P-384",
+	"secp384r1":  "P-384",
+	"P-521":      "P-521",
+	"P521":       "P-521",
+	"secp521r1":  "P-521",
+}
+
+// ecCurveAlgs maps the RFC 7518 curve names to their curve and the alg using it
+var ecCurveAlgs = map[string]struct {
+	curve elliptic.Curve
+	alg   string
+}{
+	"P-256": {elliptic.P256(), "ES256"},
+	"P-384": {elliptic.P384(), "ES384"},
+	"P-521": {elliptic.P521(), "ES512"},
+}
+
+// jwkCurve returns the elliptic curve and its RFC 7518 name for an EC key. Keys without crv fall back to the curve
+// implied by their alg. Unknown curves, such as secp256k1 (P-256K), and curves not matching the alg of the key are
+// errors naming the kid.
+func jwkCurve(key Key) (elliptic.Curve, string, error) {
+	name, ok := ecCurves[key.Crv]
+	if key.Crv == "" {
+		for curveName, curve := range ecCurveAlgs {
+			if curve.alg == key.Alg {
+				name, ok = curveName, true
+			}
+		}
+		if !ok {
+			return nil, "", fmt.Errorf("EC key %s has no crv", key.Kid)
+		}
+	}
+	if !ok {
+		return nil, "", fmt.Errorf("unsupported EC curve %q for key %s", key.Crv, key.Kid)
+	}
+	curve := ecCurveAlgs[name]
+	if key.Alg != "" && key.Alg != curve.alg {
+		return nil, "", fmt.Errorf("EC key %s with curve %s cannot be used with alg %s", key.Kid, name, key.Alg)
+	}
+	return curve.curve, name, nil
+}
+
+// duplicateKid returns the first kid of keys which is already in use with different key material, together with the
+// source using it.
+func (jwtPlugin *JwtPlugin) duplicateKid(keys map[string]interface{}, fetched map[string]interface{}, sources map[string]string) (string, string) {
+	kids := make([]string, 0, len(keys))
+	for kid := range keys {
+		kids = append(kids, kid)
+	}
+	sort.Strings(kids)
+	for _, kid := range kids {
+		if source, ok := jwtPlugin.kidSource(kid, sources); ok && (source == "configuration" || !keysEqual(fetched[kid], keys[kid])) {
+			return kid, source
+		}
+	}
+	return "", ""
+}
+
+// kidSource returns the source of a key which is already in use under the kid: an endpoint fetched earlier during
+// the same refresh, or "configuration" for the Keys and Secrets.
+func (jwtPlugin *JwtPlugin) kidSource(kid string, sources map[string]string) (string, bool) {
+	if source, ok := sources[kid]; ok {
+		return source, true
+	}
+	if _, ok := jwtPlugin.keys.Get(kid); ok {
+		if _, ok := jwtPlugin.jwksKeys[kid]; !ok {
+			return "configuration", true
+		}
+	}
+	return "", false
+}
+
+// keyExpired reports whether a key removed from its JWKS endpoint has outlived the KeyRetentionPeriod. Such keys
+// are only dropped on the next refresh, but must not be used once the retention period is over.
+func (jwtPlugin *JwtPlugin) keyExpired(key storedKey) bool {
+	return !key.expiry.IsZero() && !jwtPlugin.now().Before(key.expiry)
+}
+
+func (jwtPlugin *JwtPlugin) hasKeys() bool {
+	return len(jwtPlugin.keys.All()) > 0
+}
+
+// storedKey is a verification key together with the metadata VerifyToken needs
+type storedKey struct {
+	key interface{}
+	// alg holds the alg declared by a JWKS key, if any
+	alg string
+	// expiry is set for JWKS keys which are no longer published
+	expiry time.Time
+	// x5t holds the certificate thumbprints of keys from a certificate, by which tokens without kid find the key
+	x5t []string
+}
+
+// keyStore holds the verification keys by kid. The map is never modified once stored: writers copy it, apply their
+// change and swap it in, so VerifyToken works on a consistent snapshot without holding a lock while verifying.
+type keyStore struct {
+	lock sync.RWMutex
+	// writeLock serializes the writers, e.g. a JWKS refresh and a key file reload
+	writeLock sync.Mutex
+	keys      map[string]storedKey
+	// families holds the sorted kids of the keys usable for each algorithm family, see keyFamilies
+	families map[string][]string
+	// thumbprints maps the RFC 7638 thumbprints of the public keys to their kid
+	thumbprints map[string]string
+	// certificates maps the x5t and x5t#S256 certificate thumbprints to their kid
+	certificates map[string]string
+}
+
+func newKeyStore() *keyStore {
+	return &keyStore{keys: make(map[string]storedKey)}
+}
+
+// Snapshot returns the current keys together with the kids of the keys usable for each algorithm family. Neither
+// must be modified.
+func (store *keyStore) Snapshot() (map[string]storedKey, map[string][]string) {
+	store.lock.RLock()
+	defer store.lock.RUnlock()
+	return store.keys, store.families
+}
+
+// Thumbprint returns the public key with the RFC 7638 thumbprint, whatever kid it is stored under
+func (store *keyStore) Thumbprint(thumbprint string) (storedKey, bool) {
+	store.lock.RLock()
+	defer store.lock.RUnlock()
+	kid, ok := store.thumbprints[thumbprint]
+	if !ok {
+		return storedKey{}, false
+	}
+	return store.keys[kid], true
+}
+
+// Certificate returns the key of the certificate with the x5t or x5t#S256 thumbprint
+func (store *keyStore) Certificate(thumbprint string) (storedKey, bool) {
+	store.lock.RLock()
+	defer store.lock.RUnlock()
+	kid, ok := store.certificates[thumbprint]
+	if !ok {
+		return storedKey{}, false
+	}
+	return store.keys[kid], true
+}
+
+// Get returns the key of the kid
+func (store *keyStore) Get(kid string) (storedKey, bool) {
+	key, ok := store.All()[kid]
+	return key, ok
+}
+
+// All returns the current keys. The map must not be modified.
+func (store *keyStore) All() map[string]storedKey {
+	store.lock.RLock()
+	defer store.lock.RUnlock()
+	return store.keys
+}
+
+// Replace swaps in a new key map, which must not be modified afterwards
+func (store *keyStore) Replace(keys map[string]storedKey) {
+	families := make(map[string][]string)
+	thumbprints := make(map[string]string)
+	certificates := make(map[string]string)
+	for kid, key := range keys {
+		for _, thumbprint := range key.x5t {
+			certificates[thumbprint] = kid
+		}
+		for _, family := range keyFamilies(key.key) {
+			families[family] = append(families[family], kid)
+		}
+		if thumbprint, err := publicKeyThumbprint(key.key); err == nil {
+			thumbprints[thumbprint] = kid
+		}
+	}
+	for _, kids := range families {
+		sort.Strings(kids)
+	}
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	store.keys = keys
+	store.families = families
+	store.thumbprints = thumbprints
+	store.certificates = certificates
+}
+
+// keyFamilies returns the algorithm families a key can verify, by its type
+func keyFamilies(key interface{}) []string {
+	switch key.(type) {
+	case []byte:
+		return []string{"HS"}
+	case *rsa.PublicKey:
+		return []string{"RS", "PS"}
+	case *ecdsa.PublicKey:
+		return []string{"ES"}
+	case ed25519.PublicKey:
+		return []string{"EdDSA"}
+	}
+	return nil
+}
+
+// Update applies a change to a copy of the keys and swaps it in
+func (store *keyStore) Update(change func(keys map[string]storedKey)) {
+	store.writeLock.Lock()
+	defer store.writeLock.Unlock()
+	current := store.All()
+	keys := make(map[string]storedKey, len(current))
+	for kid, key := range current {
+		keys[kid] = key
+	}
+	change(keys)
+	store.Replace(keys)
+}
+
+// Put adds or replaces the key of the kid
+func (store *keyStore) Put(kid string, key storedKey) {
+	store.Update(func(keys map[string]storedKey) {
+		keys[kid] = key
+	})
+}
+
+// mergeKeys merges freshly fetched JWKS keys into the key map. Keys published under a known kid with
+// different material are logged (and kept unchanged when StrictKeyRotation is set). Keys which are no longer
+// published are retained for the KeyRetentionPeriod, unless the endpoint they came from could not be fetched. The
+// merged keys are swapped in at once, so VerifyToken sees either the previous or the new key set.
+func (jwtPlugin *JwtPlugin) mergeKeys(fetched map[string]interface{}, sources map[string]string, algs map[string]string, x5ts map[string][]string, failures map[string]string) {
+	jwtPlugin.keys.Update(func(keys map[string]storedKey) {
+		jwtPlugin.mergeFetchedKeys(keys, fetched, sources, algs, x5ts, failures)
+	})
+}
+
+func (jwtPlugin *JwtPlugin) mergeFetchedKeys(keys map[string]storedKey, fetched map[string]interface{}, sources map[string]string, algs map[string]string, x5ts map[string][]string, failures map[string]string) {
+	now := jwtPlugin.now()
+	for kid, key := range fetched {
+		if previous, ok := jwtPlugin.jwksKeys[kid]; !ok {
+			jwtPlugin.logKeyStoreEvent(LogEvent{Level: "info", Msg: fmt.Sprintf("JWKS key added from %s", sources[kid]), Kid: kid, Alg: algs[kid], Source: sources[kid]})
+		} else if !keysEqual(previous, key) {
+			if jwtPlugin.strictKeyRotation {
+				jwtPlugin.logKeyEvent("warning", "JWKS key material changed for existing kid, keeping previous key", kid)
+				continue
+			}
+			jwtPlugin.logKeyEvent("warning", "JWKS key material changed for existing kid", kid)
+		}
+		jwtPlugin.jwksKeys[kid] = key
+		keys[kid] = storedKey{key: key, alg: algs[kid], x5t: x5ts[kid]}
+		jwtPlugin.keySources[kid] = sources[kid]
+		delete(jwtPlugin.retiredKeys, kid)
+	}
+	for kid := range jwtPlugin.jwksKeys {
+		if _, ok := fetched[kid]; ok {
+			continue
+		}
+		if _, failed := failures[jwtPlugin.keySources[kid]]; failed {
+			continue
+		}
+		expiry, ok := jwtPlugin.retiredKeys[kid]
+		if !ok {
+			expiry = now.Add(jwtPlugin.keyRetentionPeriod)
+			jwtPlugin.retiredKeys[kid] = expiry
+			if stored, ok := keys[kid]; ok {
+				stored.expiry = expiry
+				keys[kid] = stored
+			}
+			jwtPlugin.logKeyStoreEvent(LogEvent{Level: "info", Msg: fmt.Sprintf("JWKS key removed, retained until %s", expiry.Format(time.RFC3339)), Kid: kid, Source: jwtPlugin.keySources[kid]})
+		}
+		if !now.Before(expiry) {
+			jwtPlugin.logKeyStoreEvent(LogEvent{Level: "info", Msg: "JWKS key retired", Kid: kid, Source: jwtPlugin.keySources[kid]})
+			delete(jwtPlugin.jwksKeys, kid)
+			delete(jwtPlugin.keySources, kid)
+			delete(jwtPlugin.retiredKeys, kid)
+			delete(keys, kid)
+		}
+	}
+}
+
+func (jwtPlugin *JwtPlugin) logKeyEvent(level string, msg string, kid string) {
+	jwtPlugin.logKeyStoreEvent(LogEvent{Level: level, Msg: msg, Kid: kid})
+}
+
+// logKeyStoreEvent logs a key lifecycle event, filling in the time
+func (jwtPlugin *JwtPlugin) logKeyStoreEvent(event LogEvent) {
+	event.Time = jwtPlugin.now()
+	jsonLogEvent, _ := json.Marshal(&event)
+	_, _ = fmt.Fprintln(jwtPlugin.logWriter, string(jsonLogEvent))
+}
+
+// keyCount returns the number of keys for the KeyCount of a LogEvent
+func keyCount(count int) *int {
+	return &count
+}
+
+// publicKeyPointer normalizes RSA and EC public keys to pointers, which is what the verify functions expect.
+func publicKeyPointer(key interface{}) interface{} {
+	switch k := key.(type) {
+	case rsa.PublicKey:
+		return &k
+	case ecdsa.PublicKey:
+		return &k
+	}
+	return key
+}
+
+// keySetsEqual reports whether two key maps contain the same kids with the same key material
+func keySetsEqual(a map[string]interface{}, b map[string]interface{}) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for kid, key := range a {
+		if !keysEqual(key, b[kid]) {
+			return false
+		}
+	}
+	return true
+}
+
+// keysEqual reports whether two keys contain the same key material
+func keysEqual(a interface{}, b interface{}) bool {
+	if aBytes, ok := a.([]byte); ok {
+		bBytes, ok := b.([]byte)
+		return ok && hmac.Equal(aBytes, bBytes)
+	}
+	if aKey, ok := a.(interface{ Equal(crypto.PublicKey) bool }); ok {
+		return aKey.Equal(b)
+	}
+	return false
+}
+
+func (jwtPlugin *JwtPlugin) ServeHTTP(rw http.ResponseWriter, request *http.Request) {
+	responseHeaders, authMethod, err := jwtPlugin.checkRequest(request)
+	if err != nil {
+		if denial, ok := err.(opaDenial); ok {
+			for name, value := range denial.headers {
+				rw.Header().Set(name, value)
+			}
+			rw.Header().Set("Content-Type", denial.contentType)
+			rw.Header().Set("X-Content-Type-Options", "nosniff")
+			rw.WriteHeader(denial.status)
+			_, _ = rw.Write(denial.body)
+			return
+		}
+		// nobody is left to read the response of a cancelled request
+		if err == errClientCanceled {
+			return
+		}
+		// a failed OPA query is not a denial, and its cause is only logged
+		if failure, ok := err.(opaError); ok {
+			status := http.StatusServiceUnavailable
+			if failure.timeout {
+				status = http.StatusGatewayTimeout
+			}
+			http.Error(rw, http.StatusText(status), status)
+			return
+		}
+		http.Error(rw, err.Error(), http.StatusForbidden)
+		return
+	}
+	if jwtPlugin.configReportPath != "" && authMethod != "" && request.Method == http.MethodGet && request.URL.Path == jwtPlugin.configReportPath {
+		for name, value := range responseHeaders {
+			rw.Header().Set(name, value)
+		}
+		rw.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(rw).Encode(jwtPlugin.configReport)
+		return
+	}
+	if len(responseHeaders) > 0 {
+		writer := &headerResponseWriter{ResponseWriter: rw, headers: responseHeaders}
+		jwtPlugin.next.ServeHTTP(writer, request)
+		// a backend which writes nothing gets the implicit 200 of the server, with the headers
+		if !writer.wroteHeader {
+			writer.WriteHeader(http.StatusOK)
+		}
+		return
+	}
+	jwtPlugin.next.ServeHTTP(rw, request)
+}
+
+// headerResponseWriter sets headers on the response when its status is written, replacing those of the upstream
+type headerResponseWriter struct {
+	http.ResponseWriter
+	headers     map[string]string
+	wroteHeader bool
+}
+
+func (writer *headerResponseWriter) WriteHeader(status int) {
+	if !writer.wroteHeader {
+		writer.wroteHeader = true
+		for name, value := range writer.headers {
+			writer.ResponseWriter.Header().Set(name, value)
+		}
+	}
+	writer.ResponseWriter.WriteHeader(status)
+}
+
+func (writer *headerResponseWriter) Write(data []byte) (int, error) {
+	if !writer.wroteHeader {
+		writer.WriteHeader(http.StatusOK)
+	}
+	return writer.ResponseWriter.Write(data)
+}
+
+// Flush supports streaming responses when the wrapped writer does
+func (writer *headerResponseWriter) Flush() {
+	if !writer.wroteHeader {
+		writer.WriteHeader(http.StatusOK)
+	}
+	if flusher, ok := writer.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (jwtPlugin *JwtPlugin) CheckToken(request *http.Request) error {
+	_, _, err := jwtPlugin.checkRequest(request)
+	return err
+}
+
+// checkRequest authenticates and authorizes a request, returning the headers which OPA sets on the response of an
+// allowed request and the method which authenticated it, empty when the request carried no credential
+func (jwtPlugin *JwtPlugin) checkRequest(request *http.Request) (map[string]string, string, error) {
+	if jwtPlugin.methodRules[request.Method].SkipAuth {
+		return nil, "", nil
+	}
+	jwtToken, err := jwtPlugin.ExtractToken(request)
+	if err == nil && jwtToken != nil {
+		err = jwtPlugin.checkJwt(request, jwtToken)
+	}
+	tokenFailed := err != nil
+	authMethod := ""
+	if jwtToken != nil && err == nil {
+		authMethod = authMethodJwt
+	} else if jwtPlugin.alternativeAuth == authMethodClientCert {
+		// a request is allowed when either mechanism succeeds. When both fail, the stricter error is reported: a
+		// presented but invalid credential is stricter than a missing one, and when both credentials are presented
+		// and invalid the JWT error is reported. Both are answered with 403.
+		if certErr := jwtPlugin.CheckClientCert(request); certErr == nil {
+			if err != nil {
+				jwtPlugin.logRequestEvent(request, "warning", fmt.Sprintf("JWT rejected (%v), authenticated by client certificate", err), authMethodClientCert)
+			}
+			authMethod, jwtToken, err = authMethodClientCert, nil, nil
+		} else if err == nil {
+			err = certErr
+		}
+	}
+	if err != nil && tokenFailed {
+		return nil, "", jwtPlugin.tokenRejected(request, jwtToken, err)
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	if jwtPlugin.opaUrl != "" {
+		responseHeaders, err := jwtPlugin.checkOpa(request, jwtToken, authMethod)
+		return responseHeaders, authMethod, err
+	}
+	return nil, authMethod, nil
+}
+
+// errTokenValidation is the only error which clients get for a rejected token, the reason is only logged
+var errTokenValidation = fmt.Errorf("token validation failed")
+
+// tokenRejected logs the reason of a token failure and returns the errTokenValidation, so that the client does not
+// learn which check failed. jwtToken is nil when the token could not be parsed.
+func (jwtPlugin *JwtPlugin) tokenRejected(request *http.Request, jwtToken *JWT, err error) error {
+	// the failures of the signature verification have already been logged
+	if err == errTokenValidation {
+		return err
+	}
+	if jwtToken == nil {
+		jwtPlugin.logRequestEvent(request, "warning", fmt.Sprintf("Token rejected: %v", err), authMethodJwt)
+	} else {
+		jwtPlugin.logTokenEvent(request, jwtToken, "warning", fmt.Sprintf("Token rejected: %v", err))
+	}
+	return errTokenValidation
+}
+
+// checkJwt verifies the signature and the claims of a token
+func (jwtPlugin *JwtPlugin) checkJwt(request *http.Request, jwtToken *JWT) error {
+	// unsecured tokens are rejected before anything else, even when no keys are configured
+	for token := jwtToken; token != nil; token = token.Wrapper {
+		if alg := token.Header.Alg; alg == "" || strings.EqualFold(alg, "none") || len(token.Signature) == 0 {
+			jwtPlugin.logTokenEvent(request, jwtToken, "warning", fmt.Sprintf("Rejected an unsecured token (alg %q, %d signature bytes)", alg, len(token.Signature)))
+			return fmt.Errorf("unsecured tokens are not accepted")
+		}
+	}
+	if jwtPlugin.requiredTyp != "" && normalizeTyp(jwtToken.Header.Typ) != jwtPlugin.requiredTyp {
+		return fmt.Errorf("incorrect typ header, expected %s", jwtPlugin.requiredTyp)
+	}
+	// the keys, issuer and audiences are those of the issuer of the token when Issuers are configured
+	issuer, err := jwtPlugin.tokenIssuer(jwtToken)
+	if err != nil {
+		return err
+	}
+	if err := issuer.loadLazyKeys(); err != nil {
+		jwtPlugin.logTokenEvent(request, jwtToken, "warning", fmt.Sprintf("Token verification failed: %v", err))
+		return errTokenValidation
+	}
+	// only verify jwt tokens if keys are configured
+	// the enclosing tokens of a nested token are verified against the same keys
+	if len(issuer.jwkEndpoints) > 0 || issuer.hasKeys() {
+		for token := jwtToken; token != nil; token = token.Wrapper {
+			// the reason is only logged, every verification failure looks the same to the client
+			if err := issuer.VerifyToken(token); err != nil {
+				jwtPlugin.logTokenEvent(request, jwtToken, "warning", fmt.Sprintf("Token verification failed: %v", err))
+				return errTokenValidation
+			}
+		}
+	}
+	if err := jwtPlugin.CheckSubject(request, jwtToken); err != nil {
+		return err
+	}
+	if err := jwtPlugin.CheckRevocation(jwtToken); err != nil {
+		return err
+	}
+	// all claim checks run, so that every problem with the token is logged at once
+	var failures []error
+	for _, check := range []func() error{
+		func() error { return issuer.CheckIssuer(jwtToken) },
+		func() error { return issuer.CheckAudience(jwtToken) },
+		func() error { return jwtPlugin.CheckAzp(jwtToken) },
+		func() error { return jwtPlugin.CheckEmailDomain(jwtToken) },
+		func() error { return jwtPlugin.CheckTenant(request, jwtToken) },
+		func() error { return jwtPlugin.CheckPathClaimBinding(request, jwtToken) },
+		func() error { return jwtPlugin.CheckRequiredClaims(request, jwtToken) },
+		func() error { return jwtPlugin.CheckClaimRegex(jwtToken) },
+		func() error { return jwtPlugin.CheckClaimAssertions(jwtToken) },
+		func() error { return jwtPlugin.CheckClaimAllowedValues(jwtToken) },
+		func() error { return jwtPlugin.CheckClaimExpression(jwtToken) },
+		func() error { return jwtPlugin.CheckScopes(request, jwtToken) },
+		func() error { return jwtPlugin.checkRoles(jwtToken, jwtPlugin.rolesClaim, jwtPlugin.roles) },
+		func() error { return jwtPlugin.CheckResourceAccess(jwtToken) },
+		func() error { return jwtPlugin.CheckGroups(jwtToken) },
+		func() error { return jwtPlugin.CheckAuthenticationContext(jwtToken) },
+		func() error { return jwtPlugin.CheckAuthAge(jwtToken) },
+	} {
+		if err := check(); err != nil {
+			failures = append(failures, err)
+		}
+	}
+	for _, fieldName := range jwtPlugin.payloadFields {
+		if _, ok := jwtPlugin.claim(jwtToken, fieldName); !ok {
+			if jwtPlugin.required {
+				failures = append(failures, missingClaimError{claim: fieldName, message: fmt.Sprintf("payload missing required field %s", fieldName)})
+			} else {
+				jwtPlugin.logTokenEvent(request, jwtToken, "warning", fmt.Sprintf("Missing JWT field %s", fieldName))
+			}
+		}
+	}
+	if err := joinClaimErrors(failures); err != nil {
+		return err
+	}
+	// replay protection runs last, so rejected tokens do not consume their jti
+	if err := jwtPlugin.CheckReplay(jwtToken); err != nil {
+		return err
+	}
+	for _, mapping := range jwtPlugin.headerMappings {
+		value, ok := jwtPlugin.claim(jwtToken, mapping.Claim)
+		if ok {
+			request.Header.Add(mapping.Header, claimString(value))
+		}
+	}
+	return nil
+}
+
+// CheckClientCert verifies the client certificate of the request against the configured certificate authorities
+// and subject alternative names
+func (jwtPlugin *JwtPlugin) CheckClientCert(request *http.Request) error {
+	var certs []*x509.Certificate
+	if request.TLS != nil && len(request.TLS.PeerCertificates) > 0 {
+		certs = request.TLS.PeerCertificates
+	} else if header := request.Header.Get("X-Forwarded-Tls-Client-Cert"); jwtPlugin.trustCertHeader && header != "" {
+		var err error
+		if certs, err = parseForwardedCertificates(header); err != nil {
+			return err
+		}
+	}
+	if len(certs) == 0 {
+		return fmt.Errorf("missing client certificate")
+	}
+	intermediates := x509.NewCertPool()
+	for _, cert := range certs[1:] {
+		intermediates.AddCert(cert)
+	}
+	_, err := certs[0].Verify(x509.VerifyOptions{
+		Roots:         jwtPlugin.clientCAs,
+		Intermediates: intermediates,
+		CurrentTime:   jwtPlugin.now(),
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	})
+	if err != nil {
+		return fmt.Errorf("client certificate verification failed")
+	}
+	if len(jwtPlugin.clientSANs) > 0 && !certificateHasSAN(certs[0], jwtPlugin.clientSANs) {
+		return fmt.Errorf("client certificate subject alternative name is not allowed")
+	}
+	return nil
+}
+
+// parseForwardedCertificates parses the X-Forwarded-Tls-Client-Cert header. Traefik sends a comma separated list
+// of URL-escaped certificates, either as complete PEM blocks or as base64 DER without the PEM armor.
+func parseForwardedCertificates(header string) ([]*x509.Certificate, error) {
+	unescaped, err := url.PathUnescape(header)
+	if err != nil {
+		return nil, fmt.Errorf("invalid client certificate header: %v", err)
+	}
+	var certs []*x509.Certificate
+	for _, entry := range strings.Split(unescaped, ",") {
+		var der []byte
+		if block, _ := pem.Decode([]byte(entry)); block != nil {
+			der = block.Bytes
+		} else {
+			entry = strings.NewReplacer("-----BEGIN CERTIFICATE-----", "", "-----END CERTIFICATE-----", "", "\n", "", "\r", "", " ", "").Replace(entry)
+			if der, err = base64.StdEncoding.DecodeString(entry); err != nil {
+				return nil, fmt.Errorf("invalid client certificate header: %v", err)
+			}
+		}
+		cert, err := x509.ParseCertificate(der)
+		if err != nil {
+			return nil, fmt.Errorf("invalid client certificate header: %v", err)
+		}
+		certs = append(certs, cert)
+	}
+	return certs, nil
+}
+
+// certificateHasSAN reports whether the certificate contains one of the allowed subject alternative names
+func certificateHasSAN(cert *x509.Certificate, allowed []string) bool {
+	var names []string
+	names = append(names, cert.DNSNames...)
+	names = append(names, cert.EmailAddresses...)
+	for _, uri := range cert.URIs {
+		names = append(names, uri.String())
+	}
+	for _, ip := range cert.IPAddresses {
+		names = append(names, ip.String())
+	}
+	for _, name := range names {
+		for _, san := range allowed {
+			if strings.EqualFold(name, san) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (jwtPlugin *JwtPlugin) logTokenEvent(request *http.Request, jwtToken *JWT, level string, msg string) {
+	jsonLogEvent, _ := json.Marshal(&LogEvent{
+		Level:      level,
+		Msg:        msg,
+		Time:       jwtPlugin.now(),
+		Sub:        fmt.Sprint(jwtToken.Payload["sub"]),
+		Network:    jwtPlugin.remoteAddr(request),
+		URL:        request.URL.String(),
+		AuthMethod: authMethodJwt,
+	})
+	_, _ = fmt.Fprintln(jwtPlugin.logWriter, string(jsonLogEvent))
+}
+
+func (jwtPlugin *JwtPlugin) logRequestEvent(request *http.Request, level string, msg string, authMethod string) {
+	jsonLogEvent, _ := json.Marshal(&LogEvent{
+		Level:      level,
+		Msg:        msg,
+		Time:       jwtPlugin.now(),
+		Network:    jwtPlugin.remoteAddr(request),
+		URL:        request.URL.String(),
+		AuthMethod: authMethod,
+	})
+	_, _ = fmt.Fprintln(jwtPlugin.logWriter, string(jsonLogEvent))
+}
+
+// normalizeTyp lower-cases a typ header and removes the optional "application/" prefix (RFC 7515 section 4.1.9)
+func normalizeTyp(typ string) string {
+	typ = strings.ToLower(typ)
+	return strings.TrimPrefix(typ, "application/")
+}
+
+// CheckIssuer verifies the iss claim of the token against the configured issuer. The configured issuer may contain
+// '*' wildcards, each matching any sequence of characters except '/'.
+func (jwtPlugin *JwtPlugin) CheckIssuer(jwtToken *JWT) error {
+	if jwtPlugin.iss == "" {
+		return nil
+	}
+	iss, ok := jwtToken.Payload["iss"].(string)
+	if !ok {
+		return fmt.Errorf("token is missing the iss claim")
+	}
+	if jwtPlugin.issPattern != nil {
+		if jwtPlugin.issPattern.MatchString(iss) {
+			return nil
+		}
+	} else if iss == jwtPlugin.iss {
+		return nil
+	}
+	return fmt.Errorf("token issuer %s does not match the expected issuer", iss)
+}
+
+// CheckAudience verifies that the aud claim of the token, either a string or an array, contains one of the
+// configured audiences
+func (jwtPlugin *JwtPlugin) CheckAudience(jwtToken *JWT) error {
+	if len(jwtPlugin.audiences) == 0 {
+		return nil
+	}
+	var audiences []string
+	switch aud := jwtToken.Payload["aud"].(type) {
+	case string:
+		audiences = []string{aud}
+	case []interface{}:
+		for _, a := range aud {
+			if s, ok := a.(string); ok {
+				audiences = append(audiences, s)
+			}
+		}
+	default:
+		return fmt.Errorf("token is missing the aud claim")
+	}
+	for _, aud := range audiences {
+		if containsString(jwtPlugin.audiences, aud) {
+			return nil
+		}
+	}
+	return fmt.Errorf("token audience does not match the expected audience")
+}
+
+// CheckAzp verifies the azp (authorized party) claim against the configured client ID
+func (jwtPlugin *JwtPlugin) CheckAzp(jwtToken *JWT) error {
+	if jwtPlugin.azp == "" {
+		return nil
+	}
+	value, ok := jwtPlugin.claim(jwtToken, "azp")
+	if !ok {
+		aud, _ := jwtPlugin.claim(jwtToken, "aud")
+		if aud, isArray := aud.([]interface{}); isArray && len(aud) > 1 && jwtPlugin.requireAzp {
+			return fmt.Errorf("token with multiple audiences is missing the azp claim")
+		}
+		return nil
+	}
+	if azp, ok := value.(string); !ok || azp != jwtPlugin.azp {
+		return fmt.Errorf("token authorized party (azp) does not match")
+	}
+	return nil
+}
+
+// CheckSubject verifies the sub claim against the SubjectDenylist or SubjectAllowlist. Denied subjects are logged.
+func (jwtPlugin *JwtPlugin) CheckSubject(request *http.Request, jwtToken *JWT) error {
+	if len(jwtPlugin.subjectDenylist) == 0 && len(jwtPlugin.subjectAllowlist) == 0 {
+		return nil
+	}
+	value, _ := jwtPlugin.claim(jwtToken, "sub")
+	sub, _ := value.(string)
+	if _, denied := jwtPlugin.subjectDenylist[sub]; denied {
+		jwtPlugin.logTokenEvent(request, jwtToken, "warning", "Subject is denylisted")
+		return fmt.Errorf("subject is not allowed")
+	}
+	if _, allowed := jwtPlugin.subjectAllowlist[sub]; len(jwtPlugin.subjectAllowlist) > 0 && !allowed {
+		return fmt.Errorf("subject is not allowed")
+	}
+	return nil
+}
+
+// CheckEmailDomain verifies that the email claim (EmailClaim) belongs to one of the AllowedEmailDomains. Domains
+// are compared case-insensitively, a missing or non-string claim is rejected.
+func (jwtPlugin *JwtPlugin) CheckEmailDomain(jwtToken *JWT) error {
+	if len(jwtPlugin.emailDomains) == 0 {
+		return nil
+	}
+	value, ok := jwtPlugin.claim(jwtToken, jwtPlugin.emailClaim)
+	if !ok {
+		return fmt.Errorf("payload missing email claim %s", jwtPlugin.emailClaim)
+	}
+	email, ok := value.(string)
+	if !ok {
+		return fmt.Errorf("email claim %s is not a string", jwtPlugin.emailClaim)
+	}
+	email = strings.ToLower(email)
+	for _, domain := range jwtPlugin.emailDomains {
+		if strings.HasSuffix(email, domain) {
+			return nil
+		}
+	}
+	return fmt.Errorf("email domain is not allowed")
+}
+
+func (jwtPlugin *JwtPlugin) configureTenant(config *Config) error {
+	jwtPlugin.tenantClaim = config.TenantClaim
+	jwtPlugin.tenantFromHost = config.TenantFromHost
+	if jwtPlugin.tenantFromHost == "" {
+		jwtPlugin.tenantFromHost = "subdomain"
+	}
+	if jwtPlugin.tenantFromHost != "subdomain" && jwtPlugin.tenantFromHost != "host" {
+		return fmt.Errorf("unsupported TenantFromHost %s, expected subdomain or host", config.TenantFromHost)
+	}
+	if len(config.TenantHostMapping) > 0 && config.TenantClaim == "" {
+		return fmt.Errorf("TenantHostMapping requires TenantClaim")
+	}
+	jwtPlugin.tenantMapping = make(map[string]string)
+	for component, tenant := range config.TenantHostMapping {
+		jwtPlugin.tenantMapping[strings.ToLower(component)] = tenant
+	}
+	return nil
+}
+
+// CheckTenant verifies that the TenantClaim matches the tenant taken from the Host header. Host components are
+// compared case-insensitively after removing the port, and translated with the TenantHostMapping.
+func (jwtPlugin *JwtPlugin) CheckTenant(request *http.Request, jwtToken *JWT) error {
+	if jwtPlugin.tenantClaim == "" {
+		return nil
+	}
+	host := request.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	tenant := host
+	if jwtPlugin.tenantFromHost == "subdomain" {
+		i := strings.Index(host, ".")
+		if i <= 0 {
+			return fmt.Errorf("host %s has no subdomain", host)
+		}
+		tenant = host[:i]
+	}
+	if mapped, ok := jwtPlugin.tenantMapping[tenant]; ok {
+		tenant = mapped
+	}
+	value, ok := jwtPlugin.claim(jwtToken, jwtPlugin.tenantClaim)
+	if !ok {
+		return fmt.Errorf("payload missing tenant claim %s", jwtPlugin.tenantClaim)
+	}
+	if claimString(value) != tenant {
+		return fmt.Errorf("claim %s does not match the tenant of host %s", jwtPlugin.tenantClaim, host)
+	}
+	return nil
+}
+
+// pathSegment is a segment of a PathClaimBinding pattern, either a literal or the name of a claim
+type pathSegment struct {
+	literal string
+	claim   string
+}
+
+// compilePathBinding splits a PathClaimBinding pattern into segments. Named segments must span a whole segment,
+// e.g. "/users/{sub}" or "/tenants/{tenant}/users/{sub}".
+func compilePathBinding(pattern string) ([]pathSegment, error) {
+	if !strings.HasPrefix(pattern, "/") {
+		return nil, fmt.Errorf("PathClaimBinding pattern %s must start with /", pattern)
+	}
+	var segments []pathSegment
+	named := false
+	for _, s := range strings.Split(strings.TrimPrefix(pattern, "/"), "/") {
+		if strings.HasPrefix(s, "{") && strings.HasSuffix(s, "}") && len(s) > 2 {
+			segments = append(segments, pathSegment{claim: s[1 : len(s)-1]})
+			named = true
+			continue
+		}
+		if strings.ContainsAny(s, "{}") {
+			return nil, fmt.Errorf("invalid segment %s in PathClaimBinding pattern %s", s, pattern)
+		}
+		segments = append(segments, pathSegment{literal: s})
+	}
+	if !named {
+		return nil, fmt.Errorf("PathClaimBinding pattern %s has no named segment", pattern)
+	}
+	return segments, nil
+}
+
+// CheckPathClaimBinding verifies the named segments of the PathClaimBinding patterns matching the start of the
+// request path against the claims. Path segments are unescaped before they are compared.
+func (jwtPlugin *JwtPlugin) CheckPathClaimBinding(request *http.Request, jwtToken *JWT) error {
+	if len(jwtPlugin.pathBindings) == 0 {
+		return nil
+	}
+	escaped := strings.Split(strings.TrimPrefix(request.URL.EscapedPath(), "/"), "/")
+	path := make([]string, len(escaped))
+	for i, s := range escaped {
+		segment, err := url.PathUnescape(s)
+		if err != nil {
+			return fmt.Errorf("invalid request path: %v", err)
+		}
+		path[i] = segment
+	}
+	for _, binding := range jwtPlugin.pathBindings {
+		if !pathBindingMatches(binding, path) {
+			continue
+		}
+		for i, segment := range binding {
+			if segment.claim == "" {
+				continue
+			}
+			value, ok := jwtPlugin.claim(jwtToken, segment.claim)
+			if !ok {
+				return fmt.Errorf("payload missing claim %s bound to the request path", segment.claim)
+			}
+			if claimString(value) != path[i] {
+				return fmt.Errorf("claim %s does not match the request path", segment.claim)
+			}
+		}
+	}
+	return nil
+}
+
+// pathBindingMatches reports whether the literal segments of the binding match the start of the path
+func pathBindingMatches(binding []pathSegment, path []string) bool {
+	if len(path) < len(binding) {
+		return false
+	}
+	for i, segment := range binding {
+		if segment.claim == "" && segment.literal != path[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// CheckRevocation rejects tokens whose jti is in the revocation list
+func (jwtPlugin *JwtPlugin) CheckRevocation(jwtToken *JWT) error {
+	if jwtPlugin.revocationUrl == "" {
+		return nil
+	}
+	jwtPlugin.revocationLock.RLock()
+	defer jwtPlugin.revocationLock.RUnlock()
+	if jwtPlugin.revocationFailed && jwtPlugin.revocationFailure == "closed" {
+		return fmt.Errorf("token revocation list is unavailable")
+	}
+	if jti, ok := jwtToken.Payload["jti"].(string); ok {
+		if _, revoked := jwtPlugin.revoked[jti]; revoked {
+			return fmt.Errorf("token has been revoked")
+		}
+	}
+	return nil
+}
+
+// CheckReplay rejects tokens whose jti has been seen before, when ReplayProtection is enabled. A jti is remembered
+// until the exp of its token, and at least for the ReplayTTL, so a token whose exp has passed cannot be replayed.
+func (jwtPlugin *JwtPlugin) CheckReplay(jwtToken *JWT) error {
+	if jwtPlugin.replayCache == nil {
+		return nil
+	}
+	jti, ok := jwtToken.Payload["jti"].(string)
+	if !ok || jti == "" {
+		return fmt.Errorf("token is missing the jti claim required for replay protection")
+	}
+	now := jwtPlugin.now()
+	expiry := now.Add(jwtPlugin.replayCache.ttl)
+	if exp, ok := jwtToken.Payload["exp"].(float64); ok && time.Unix(int64(exp), 0).After(expiry) {
+		expiry = time.Unix(int64(exp), 0)
+	}
+	added, full := jwtPlugin.replayCache.add(jti, expiry, now)
+	if full {
+		return replayCacheFullError{size: jwtPlugin.replayCache.size}
+	}
+	if !added {
+		return fmt.Errorf("token has already been used")
+	}
+	return nil
+}
+
+// replayCacheFullError rejects a token because the replay cache only holds jti values which have not expired yet.
+// Evicting one of them would make its token replayable.
+type replayCacheFullError struct {
+	size int
+}
+
+func (e replayCacheFullError) Error() string {
+	return fmt.Sprintf("replay cache is full (%d unexpired jti values), rejecting the token", e.size)
+}
+
+// replayCache remembers keys (the jti values of ReplayProtection, or unknown kids) until their expiry. The entries
+// are kept in a heap ordered by expiry, so the expired entries are dropped first whatever their insertion order.
+// When the cache is full of unexpired entries, a new key is refused, unless evictLive allows evicting the entry
+// which expires first. Each entry costs roughly the length of the key plus 100 bytes, so the default of 10000
+// entries stays around 1-2 MB.
+type replayCache struct {
+	lock      sync.Mutex
+	size      int
+	ttl       time.Duration
+	evictLive bool
+	entries   map[string]*replayEntry
+	expiries  replayHeap
+}
+
+type replayEntry struct {
+	jti    string
+	expiry time.Time
+	// index is the position of the entry in the heap
+	index int
+}
+
+// replayHeap implements heap.Interface over the entries of a replayCache, the entry expiring first at the root
+type replayHeap []*replayEntry
+
+func (h replayHeap) Len() int           { return len(h) }
+func (h replayHeap) Less(i, j int) bool { return h[i].expiry.Before(h[j].expiry) }
+func (h replayHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index, h[j].index = i, j
+}
+
+func (h *replayHeap) Push(x interface{}) {
+	entry := x.(*replayEntry)
+	entry.index = len(*h)
+	*h = append(*h, entry)
+}
+
+func (h *replayHeap) Pop() interface{} {
+	old := *h
+	entry := old[len(old)-1]
+	old[len(old)-1] = nil
+	*h = old[:len(old)-1]
+	return entry
+}
+
+func newReplayCache(size int, ttl time.Duration) *replayCache {
+	return &replayCache{
+		size:    size,
+		ttl:     ttl,
+		entries: make(map[string]*replayEntry),
+	}
+}
+
+// add records a key until its expiry. It reports whether the key was added: not when it has been recorded before
+// and has not expired yet, nor when the cache is full of unexpired entries and evictLive is not set, which is
+// reported by full.
+func (cache *replayCache) add(jti string, expiry time.Time, now time.Time) (added bool, full bool) {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+	if entry, ok := cache.entries[jti]; ok && now.Before(entry.expiry) {
+		return false, false
+	}
+	for len(cache.expiries) > 0 && !now.Before(cache.expiries[0].expiry) {
+		cache.remove(cache.expiries[0])
+	}
+	if len(cache.expiries) >= cache.size {
+		if !cache.evictLive {
+			return false, true
+		}
+		cache.remove(cache.expiries[0])
+	}
+	entry := &replayEntry{jti: jti, expiry: expiry}
+	cache.entries[jti] = entry
+	heap.Push(&cache.expiries, entry)
+	return true, false
+}
+
+// contains reports whether a key has been recorded and has not expired yet
+func (cache *replayCache) contains(jti string, now time.Time) bool {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+	entry, ok := cache.entries[jti]
+	return ok && now.Before(entry.expiry)
+}
+
+func (cache *replayCache) remove(entry *replayEntry) {
+	delete(cache.entries, entry.jti)
+	heap.Remove(&cache.expiries, entry.index)
+}
+
+// CheckRequiredClaims verifies that the required claims have one of the expected values. The PathClaims rule
+// matching the request path takes precedence over the MethodRules entry of the request method, which takes
+// precedence over RequireClaims.
+func (jwtPlugin *JwtPlugin) CheckRequiredClaims(request *http.Request, jwtToken *JWT) error {
+	required := jwtPlugin.requiredClaimsFor(request)
+	names := make([]string, 0, len(required))
+	for name := range required {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var failures []error
+	for _, name := range names {
+		value, ok := jwtPlugin.claim(jwtToken, name)
+		if !ok {
+			failures = append(failures, missingClaimError{claim: name, message: fmt.Sprintf("payload missing required claim %s", name)})
+		} else if !claimMatchesAny(value, required[name]) {
+			failures = append(failures, fmt.Errorf("claim %s does not have the required value", name))
+		}
+	}
+	return joinClaimErrors(failures)
+}
+
+// missingClaimError reports a missing claim, so that several missing claims can be reported together
+type missingClaimError struct {
+	claim   string
+	message string
+}
+
+func (err missingClaimError) Error() string {
+	return err.message
+}
+
+// claimErrors contains several claim check failures
+type claimErrors []error
+
+func (errs claimErrors) Error() string {
+	var missing, messages []string
+	for _, err := range errs {
+		if m, ok := err.(missingClaimError); ok {
+			missing = append(missing, m.claim)
+		} else {
+			messages = append(messages, err.Error())
+		}
+	}
+	if len(missing) > 0 {
+		messages = append([]string{"missing claims: " + strings.Join(missing, ", ")}, messages...)
+	}
+	return strings.Join(messages, "; ")
+}
+
+// joinClaimErrors combines claim check failures into a single error. A single failure is returned as-is.
+func joinClaimErrors(failures []error) error {
+	var flattened claimErrors
+	for _, err := range failures {
+		if errs, ok := err.(claimErrors); ok {
+			flattened = append(flattened, errs...)
+		} else {
+			flattened = append(flattened, err)
+		}
+	}
+	switch len(flattened) {
+	case 0:
+		return nil
+	case 1:
+		return flattened[0]
+	}
+	return flattened
+}
+
+// requiredClaimsFor returns the required claims of the PathClaims rule with the longest prefix of the request
+// path, or of the MethodRules entry of the request method, falling back to RequireClaims
+func (jwtPlugin *JwtPlugin) requiredClaimsFor(request *http.Request) map[string]interface{} {
+	for _, rule := range jwtPlugin.pathClaims {
+		if strings.HasPrefix(request.URL.Path, rule.PathPrefix) {
+			return rule.RequireClaims
+		}
+	}
+	if rule, ok := jwtPlugin.methodRules[request.Method]; ok && rule.RequireClaims != nil {
+		return rule.RequireClaims
+	}
+	return jwtPlugin.requireClaims
+}
+
+// CheckClaimRegex verifies the claims configured in ClaimRegex against their regular expression. Missing claims
+// are only rejected when Required is set.
+func (jwtPlugin *JwtPlugin) CheckClaimRegex(jwtToken *JWT) error {
+	names := make([]string, 0, len(jwtPlugin.claimRegex))
+	for name := range jwtPlugin.claimRegex {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var failures []error
+	for _, name := range names {
+		value, ok := jwtPlugin.claim(jwtToken, name)
+		if !ok {
+			if jwtPlugin.required {
+				failures = append(failures, missingClaimError{claim: name, message: fmt.Sprintf("payload missing required claim %s", name)})
+			}
+		} else if !jwtPlugin.claimRegex[name].MatchString(claimString(value)) {
+			failures = append(failures, fmt.Errorf("claim %s does not match the required pattern", name))
+		}
+	}
+	return joinClaimErrors(failures)
+}
+
+// CheckClaimAllowedValues verifies that the claims configured in ClaimAllowedValues have one of the allowed
+// values. Array claims are only accepted with ClaimAllowedValuesMatchArray, when any of their elements is allowed.
+func (jwtPlugin *JwtPlugin) CheckClaimAllowedValues(jwtToken *JWT) error {
+	names := make([]string, 0, len(jwtPlugin.allowedValues))
+	for name := range jwtPlugin.allowedValues {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var failures []error
+	for _, name := range names {
+		value, ok := jwtPlugin.claim(jwtToken, name)
+		if !ok {
+			failures = append(failures, missingClaimError{claim: name, message: fmt.Sprintf("payload missing required claim %s", name)})
+			continue
+		}
+		candidates := []interface{}{value}
+		if array, isArray := value.([]interface{}); isArray {
+			if !jwtPlugin.allowedMatchArray {
+				failures = append(failures, fmt.Errorf("claim %s is an array", name))
+				continue
+			}
+			candidates = array
+		}
+		if !anyClaimAllowed(candidates, jwtPlugin.allowedValues[name]) {
+			failures = append(failures, fmt.Errorf("claim %s does not have one of the allowed values", name))
+		}
+	}
+	return joinClaimErrors(failures)
+}
+
+func anyClaimAllowed(candidates []interface{}, allowed []interface{}) bool {
+	for _, candidate := range candidates {
+		for _, a := range allowed {
+			if claimEquals(candidate, a) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// CheckClaimExpression evaluates the ClaimExpression against the payload
+func (jwtPlugin *JwtPlugin) CheckClaimExpression(jwtToken *JWT) error {
+	if jwtPlugin.expression == nil {
+		return nil
+	}
+	matched, err := evalBool(jwtPlugin.expression, jwtToken.Payload)
+	if err != nil {
+		return fmt.Errorf("failed to evaluate ClaimExpression: %v", err)
+	}
+	if !matched {
+		return fmt.Errorf("token does not satisfy the ClaimExpression")
+	}
+	return nil
+}
+
+// claim looks up a claim of the token, folding case when ClaimLookupCaseInsensitive is set
+func (jwtPlugin *JwtPlugin) claim(jwtToken *JWT, path string) (interface{}, bool) {
+	return lookupClaim(jwtToken.Payload, path, jwtPlugin.foldClaims)
+}
+
+// lookupClaim returns the claim at the given path. A claim name which exists at the top level of the payload is
+// used as-is, otherwise the path is split on dots to walk nested objects (e.g. "realm_access.roles"). A literal dot
+// in a claim name can be escaped as "\.", and a literal backslash as "\\". With fold, names which only differ by
+// case match when there is no exact match.
+func lookupClaim(payload map[string]interface{}, path string, fold bool) (interface{}, bool) {
+	if value, ok := claimField(payload, path, fold); ok {
+		return value, true
+	}
+	var value interface{} = payload
+	for _, segment := range splitClaimPath(path) {
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		if value, ok = claimField(object, segment, fold); !ok {
+			return nil, false
+		}
+	}
+	return value, true
+}
+
+// claimField returns the field of a claim object. With fold, a field whose name only differs by case is used when
+// there is no exact match. When several fields differ only by case, the first name in byte order wins.
+func claimField(object map[string]interface{}, name string, fold bool) (interface{}, bool) {
+	if value, ok := object[name]; ok || !fold {
+		return value, ok
+	}
+	match, found := "", false
+	for key := range object {
+		if strings.EqualFold(key, name) && (!found || key < match) {
+			match, found = key, true
+		}
+	}
+	if !found {
+		return nil, false
+	}
+	return object[match], true
+}
+
+// splitClaimPath splits a claim path on unescaped dots
+func splitClaimPath(path string) []string {
+	var segments []string
+	var segment strings.Builder
+	for i := 0; i < len(path); i++ {
+		switch c := path[i]; {
+		case c == '\\' && i+1 < len(path):
+			i++
+			segment.WriteByte(path[i])
+		case c == '.':
+			segments = append(segments, segment.String())
+			segment.Reset()
+		default:
+			segment.WriteByte(c)
+		}
+	}
+	return append(segments, segment.String())
+}
+
+// CheckScopes verifies that the scope claim (ScopeClaim) contains the required scopes. The claim may either be a
+// space delimited string or an array of strings. The RequiredScopes of the MethodRules entry of the request method
+// replace the global RequiredScopes.
+func (jwtPlugin *JwtPlugin) CheckScopes(request *http.Request, jwtToken *JWT) error {
+	required := jwtPlugin.scopes
+	if rule, ok := jwtPlugin.methodRules[request.Method]; ok && rule.RequiredScopes != nil {
+		required = rule.RequiredScopes
+	}
+	if len(required) == 0 {
+		return nil
+	}
+	value, ok := jwtPlugin.claim(jwtToken, jwtPlugin.scopeClaim)
+	if !ok {
+		return missingClaimError{claim: jwtPlugin.scopeClaim, message: fmt.Sprintf("payload missing required claim %s", jwtPlugin.scopeClaim)}
+	}
+	var scopes []string
+	if s, isString := value.(string); isString {
+		scopes = strings.Fields(s)
+	} else if scopes, ok = stringArray(value); !ok {
+		return fmt.Errorf("claim %s is not a string or an array of strings", jwtPlugin.scopeClaim)
+	}
+	var missing []string
+	for _, scope := range required {
+		if containsString(scopes, scope) {
+			if jwtPlugin.anyScope {
+				return nil
+			}
+		} else {
+			missing = append(missing, scope)
+		}
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+	if jwtPlugin.anyScope {
+		return fmt.Errorf("token is missing one of the required scopes %s", strings.Join(missing, ", "))
+	}
+	return fmt.Errorf("token is missing the required scopes %s", strings.Join(missing, ", "))
+}
+
+// checkRoles verifies that the array of strings at the claim path contains all the required roles
+func (jwtPlugin *JwtPlugin) checkRoles(jwtToken *JWT, path string, required []string) error {
+	if len(required) == 0 {
+		return nil
+	}
+	value, ok := jwtPlugin.claim(jwtToken, path)
+	if !ok {
+		return fmt.Errorf("payload missing roles claim %s", path)
+	}
+	roles, ok := stringArray(value)
+	if !ok {
+		return fmt.Errorf("roles claim %s is not an array of strings", path)
+	}
+	var missing []string
+	for _, role := range required {
+		if !containsString(roles, role) {
+			missing = append(missing, role)
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("token is missing the required roles %s", strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+// CheckResourceAccess verifies the Keycloak client roles in resource_access.<client>.roles
+func (jwtPlugin *JwtPlugin) CheckResourceAccess(jwtToken *JWT) error {
+	if len(jwtPlugin.resourceAccess.Roles) == 0 {
+		return nil
+	}
+	client := jwtPlugin.resourceAccess.Client
+	value, ok := jwtPlugin.claim(jwtToken, "resource_access")
+	if !ok {
+		return fmt.Errorf("payload missing claim resource_access")
+	}
+	resourceAccess, ok := value.(map[string]interface{})
+	if !ok {
+		return fmt.Errorf("claim resource_access is not an object")
+	}
+	if _, ok := claimField(resourceAccess, client, jwtPlugin.foldClaims); !ok {
+		return fmt.Errorf("token has no resource_access roles for client %s", client)
+	}
+	return jwtPlugin.checkRoles(jwtToken, "resource_access."+escapeClaimPath(client)+".roles", jwtPlugin.resourceAccess.Roles)
+}
+
+// CheckGroups verifies that the groups claim (GroupsClaim) contains at least one of the required groups
+func (jwtPlugin *JwtPlugin) CheckGroups(jwtToken *JWT) error {
+	if len(jwtPlugin.groups) == 0 {
+		return nil
+	}
+	value, ok := jwtPlugin.claim(jwtToken, jwtPlugin.groupsClaim)
+	if !ok {
+		return fmt.Errorf("payload missing groups claim %s", jwtPlugin.groupsClaim)
+	}
+	groups, ok := stringArray(value)
+	if !ok {
+		return fmt.Errorf("groups claim %s is not an array of strings", jwtPlugin.groupsClaim)
+	}
+	for _, group := range jwtPlugin.groups {
+		if containsString(groups, group) {
+			return nil
+		}
+	}
+	return fmt.Errorf("token is not a member of any of the required groups")
+}
+
+// CheckAuthenticationContext verifies the amr claim against RequiredAmr and the acr claim against RequiredAcr. When
+// both are configured, satisfying either of them is sufficient. Missing claims fail the check.
+func (jwtPlugin *JwtPlugin) CheckAuthenticationContext(jwtToken *JWT) error {
+	if len(jwtPlugin.amr) == 0 && jwtPlugin.acr == "" {
+		return nil
+	}
+	if len(jwtPlugin.amr) > 0 {
+		value, _ := jwtPlugin.claim(jwtToken, "amr")
+		amr, _ := stringArray(value)
+		for _, method := range jwtPlugin.amr {
+			if containsString(amr, method) {
+				return nil
+			}
+		}
+	}
+	if jwtPlugin.acr != "" {
+		value, _ := jwtPlugin.claim(jwtToken, "acr")
+		acr, _ := value.(string)
+		if len(jwtPlugin.acrValues) == 0 {
+			if acr == jwtPlugin.acr {
+				return nil
+			}
+		} else if indexOf(jwtPlugin.acrValues, acr) >= indexOf(jwtPlugin.acrValues, jwtPlugin.acr) {
+			return nil
+		}
+	}
+	return fmt.Errorf("step-up authentication required")
+}
+
+// CheckAuthAge verifies that the user authenticated within MaxAuthAge, allowing for the Leeway
+func (jwtPlugin *JwtPlugin) CheckAuthAge(jwtToken *JWT) error {
+	if jwtPlugin.maxAuthAge == 0 {
+		return nil
+	}
+	value, _ := jwtPlugin.claim(jwtToken, "auth_time")
+	authTime, ok := value.(float64)
+	if !ok {
+		return fmt.Errorf("token is missing the auth_time claim, re-authentication required")
+	}
+	authenticated := time.Unix(0, int64(authTime*float64(time.Second)))
+	if jwtPlugin.now().After(authenticated.Add(jwtPlugin.maxAuthAge + jwtPlugin.leeway)) {
+		return fmt.Errorf("authentication is older than %s, re-authentication required", jwtPlugin.maxAuthAge)
+	}
+	return nil
+}
+
+func indexOf(values []string, value string) int {
+	for i, v := range values {
+		if v == value {
+			return i
+		}
+	}
+	return -1
+}
+
+// escapeClaimPath escapes a claim name for use as a single segment of a claim path
+func escapeClaimPath(name string) string {
+	return strings.NewReplacer("\\", "\\\\", ".", "\\.").Replace(name)
+}
+
+// stringArray converts a decoded JSON array of strings
+func stringArray(value interface{}) ([]string, bool) {
+	array, ok := value.([]interface{})
+	if !ok {
+		return nil, false
+	}
+	strs := make([]string, 0, len(array))
+	for _, v := range array {
+		s, ok := v.(string)
+		if !ok {
+			return nil, false
+		}
+		strs = append(strs, s)
+	}
+	return strs, true
+}
+
+// claimAssertion is a validated ClaimAssertion
+type claimAssertion struct {
+	claim     string
+	op        string
+	number    float64
+	isBoolean bool
+	boolean   bool
+	lenient   bool
+}
+
+func compileClaimAssertion(assertion ClaimAssertion) (claimAssertion, error) {
+	if assertion.Claim == "" {
+		return claimAssertion{}, fmt.Errorf("ClaimAssertions entry is missing the claim name")
+	}
+	switch assertion.Op {
+	case "eq", "ne", "gt", "ge", "lt", "le":
+	default:
+		return claimAssertion{}, fmt.Errorf("unsupported ClaimAssertions operator %s for claim %s", assertion.Op, assertion.Claim)
+	}
+	if boolean, ok := toBool(assertion.Value); ok {
+		if assertion.Op != "eq" && assertion.Op != "ne" {
+			return claimAssertion{}, fmt.Errorf("ClaimAssertions operator %s is not supported for boolean claim %s", assertion.Op, assertion.Claim)
+		}
+		return claimAssertion{claim: assertion.Claim, op: assertion.Op, isBoolean: true, boolean: boolean, lenient: assertion.Lenient}, nil
+	}
+	number, ok := toFloat(assertion.Value)
+	if !ok {
+		return claimAssertion{}, fmt.Errorf("ClaimAssertions value for claim %s is not a number or a boolean", assertion.Claim)
+	}
+	return claimAssertion{claim: assertion.Claim, op: assertion.Op, number: number}, nil
+}
+
+// toBool converts a configured boolean value, given either as a bool or as the string "true" or "false"
+func toBool(value interface{}) (bool, bool) {
+	switch v := value.(type) {
+	case bool:
+		return v, true
+	case string:
+		if strings.EqualFold(v, "true") {
+			return true, true
+		}
+		if strings.EqualFold(v, "false") {
+			return false, true
+		}
+	}
+	return false, false
+}
+
+// CheckClaimAssertions verifies the ClaimAssertions. A missing claim or a claim of the wrong type fails the
+// assertion.
+func (jwtPlugin *JwtPlugin) CheckClaimAssertions(jwtToken *JWT) error {
+	var failures []error
+	for _, assertion := range jwtPlugin.assertions {
+		value, ok := jwtPlugin.claim(jwtToken, assertion.claim)
+		if !ok {
+			failures = append(failures, missingClaimError{claim: assertion.claim, message: fmt.Sprintf("payload missing required claim %s", assertion.claim)})
+		} else if assertion.isBoolean {
+			if !assertion.matchesBoolean(value) {
+				failures = append(failures, fmt.Errorf("claim %s does not satisfy %s %t", assertion.claim, assertion.op, assertion.boolean))
+			}
+		} else if !assertion.matches(value) {
+			failures = append(failures, fmt.Errorf("claim %s does not satisfy %s %s", assertion.claim, assertion.op, strconv.FormatFloat(assertion.number, 'f', -1, 64)))
+		}
+	}
+	return joinClaimErrors(failures)
+}
+
+// matchesBoolean compares a boolean claim. Strings are only accepted when the assertion is lenient, any other
+// type fails the assertion.
+func (assertion claimAssertion) matchesBoolean(value interface{}) bool {
+	boolean, ok := value.(bool)
+	if s, isString := value.(string); isString && assertion.lenient {
+		boolean, ok = toBool(s)
+	}
+	if !ok {
+		return false
+	}
+	return (boolean == assertion.boolean) == (assertion.op == "eq")
+}
+
+func (assertion claimAssertion) matches(value interface{}) bool {
+	number, ok := value.(float64)
+	if !ok {
+		return false
+	}
+	switch assertion.op {
+	case "eq":
+		return number == assertion.number
+	case "ne":
+		return number != assertion.number
+	case "gt":
+		return number > assertion.number
+	case "ge":
+		return number >= assertion.number
+	case "lt":
+		return number < assertion.number
+	case "le":
+		return number <= assertion.number
+	}
+	return false
+}
+
+// claimExpression is a compiled ClaimExpression. The syntax supports the operators ||, &&, !, ==, !=, <, <=, >
+// and >=, parentheses, string, number and boolean literals, null, claim references like payload.role or
+// payload["https://example.com/roles"], and the function contains(list or string, value).
+type claimExpression interface {
+	eval(payload map[string]interface{}) (interface{}, error)
+}
+
+type exprLiteral struct {
+	value interface{}
+}
+
+type exprClaim struct {
+	path []string
+}
+
+type exprNot struct {
+	operand claimExpression
+}
+
+type exprBinary struct {
+	op          string
+	left, right claimExpression
+}
+
+type exprContains struct {
+	collection, value claimExpression
+}
+
+func (e exprLiteral) eval(map[string]interface{}) (interface{}, error) {
+	return e.value, nil
+}
+
+// eval returns the claim, or nil when it does not exist
+func (e exprClaim) eval(payload map[string]interface{}) (interface{}, error) {
+	var value interface{} = payload
+	for _, segment := range e.path {
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return nil, nil
+		}
+		value = object[segment]
+	}
+	return value, nil
+}
+
+func (e exprNot) eval(payload map[string]interface{}) (interface{}, error) {
+	value, err := evalBool(e.operand, payload)
+	if err != nil {
+		return nil, err
+	}
+	return !value, nil
+}
+
+func (e exprBinary) eval(payload map[string]interface{}) (interface{}, error) {
+	if e.op == "&&" || e.op == "||" {
+		left, err := evalBool(e.left, payload)
+		if err != nil {
+			return nil, err
+		}
+		if left == (e.op == "||") {
+			return left, nil
+		}
+		return evalBool(e.right, payload)
+	}
+	left, err := e.left.eval(payload)
+	if err != nil {
+		return nil, err
+	}
+	right, err := e.right.eval(payload)
+	if err != nil {
+		return nil, err
+	}
+	switch e.op {
+	case "==":
+		return expressionEquals(left, right), nil
+	case "!=":
+		return !expressionEquals(left, right), nil
+	}
+	// ordering comparisons are false unless both operands are numbers or both are strings
+	if l, ok := left.(float64); ok {
+		r, ok := right.(float64)
+		return ok && compareOrdered(e.op, l < r, l == r), nil
+	}
+	if l, ok := left.(string); ok {
+		r, ok := right.(string)
+		return ok && compareOrdered(e.op, l < r, l == r), nil
+	}
+	return false, nil
+}
+
+func (e exprContains) eval(payload map[string]interface{}) (interface{}, error) {
+	collection, err := e.collection.eval(payload)
+	if err != nil {
+		return nil, err
+	}
+	value, err := e.value.eval(payload)
+	if err != nil {
+		return nil, err
+	}
+	switch c := collection.(type) {
+	case []interface{}:
+		for _, element := range c {
+			if expressionEquals(element, value) {
+				return true, nil
+			}
+		}
+	case string:
+		s, ok := value.(string)
+		return ok && strings.Contains(c, s), nil
+	}
+	return false, nil
+}
+
+func evalBool(expression claimExpression, payload map[string]interface{}) (bool, error) {
+	value, err := expression.eval(payload)
+	if err != nil {
+		return false, err
+	}
+	b, ok := value.(bool)
+	if !ok {
+		return false, fmt.Errorf("expected a boolean, got %s", claimString(value))
+	}
+	return b, nil
+}
+
+func expressionEquals(left interface{}, right interface{}) bool {
+	switch left.(type) {
+	case nil:
+		return right == nil
+	case string, float64, bool:
+		return left == right
+	}
+	return false
+}
+
+func compareOrdered(op string, less bool, equal bool) bool {
+	switch op {
+	case "<":
+		return less
+	case "<=":
+		return less || equal
+	case ">":
+		return !less && !equal
+	case ">=":
+		return !less
+	}
+	return false
+}
+
+// exprToken is a token of a ClaimExpression
+type exprToken struct {
+	kind  string // "ident", "string", "number", "op" or "eof"
+	text  string
+	value interface{}
+	pos   int
+}
+
+func tokenizeExpression(expression string) ([]exprToken, error) {
+	var tokens []exprToken
+	for i := 0; i < len(expression); {
+		c := expression[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case c == '"':
+			end := i + 1
+			for end < len(expression) && expression[end] != '"' {
+				if expression[end] == '\\' {
+					end++
+				}
+				end++
+			}
+			if end >= len(expression) {
+				return nil, fmt.Errorf("unterminated string at position %d", i)
+			}
+			s, err := strconv.Unquote(expression[i : end+1])
+			if err != nil {
+				return nil, fmt.Errorf("invalid string at position %d", i)
+			}
+			tokens = append(tokens, exprToken{kind: "string", text: expression[i : end+1], value: s, pos: i})
+			i = end + 1
+		case c >= '0' && c <= '9' || c == '-' && i+1 < len(expression) && expression[i+1] >= '0' && expression[i+1] <= '9':
+			end := i + 1
+			for end < len(expression) && strings.IndexByte("0123456789.eE+-", expression[end]) >= 0 {
+				end++
+			}
+			f, err := strconv.ParseFloat(expression[i:end], 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid number %s at position %d", expression[i:end], i)
+			}
+			tokens = append(tokens, exprToken{kind: "number", text: expression[i:end], value: f, pos: i})
+			i = end
+		case c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z':
+			end := i + 1
+			for end < len(expression) && (expression[end] == '_' || expression[end] >= 'a' && expression[end] <= 'z' ||
+				expression[end] >= 'A' && expression[end] <= 'Z' || expression[end] >= '0' && expression[end] <= '9') {
+				end++
+			}
+			tokens = append(tokens, exprToken{kind: "ident", text: expression[i:end], pos: i})
+			i = end
+		default:
+			op := ""
+			for _, candidate := range []string{"||", "&&", "==", "!=", "<=", ">=", "<", ">", "!", "(", ")", "[", "]", ".", ","} {
+				if strings.HasPrefix(expression[i:], candidate) {
+					op = candidate
+					break
+				}
+			}
+			if op == "" {
+				return nil, fmt.Errorf("unexpected character %q at position %d", c, i)
+			}
+			tokens = append(tokens, exprToken{kind: "op", text: op, pos: i})
+			i += len(op)
+		}
+	}
+	return append(tokens, exprToken{kind: "eof", pos: len(expression)}), nil
+}
+
+// exprParser is a recursive descent parser for ClaimExpression
+type exprParser struct {
+	tokens []exprToken
+	pos    int
+}
+
+func compileClaimExpression(expression string) (claimExpression, error) {
+	tokens, err := tokenizeExpression(expression)
+	if err != nil {
+		return nil, err
+	}
+	parser := &exprParser{tokens: tokens}
+	compiled, err := parser.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if next := parser.peek(); next.kind != "eof" {
+		return nil, fmt.Errorf("unexpected %s at position %d", next.text, next.pos)
+	}
+	return compiled, nil
+}
+
+func (p *exprParser) peek() exprToken {
+	return p.tokens[p.pos]
+}
+
+func (p *exprParser) next() exprToken {
+	token := p.tokens[p.pos]
+	if token.kind != "eof" {
+		p.pos++
+	}
+	return token
+}
+
+func (p *exprParser) accept(op string) bool {
+	if token := p.peek(); token.kind == "op" && token.text == op {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *exprParser) expect(op string) error {
+	if !p.accept(op) {
+		return p.unexpected("expected " + op)
+	}
+	return nil
+}
+
+func (p *exprParser) unexpected(message string) error {
+	token := p.peek()
+	if token.kind == "eof" {
+		return fmt.Errorf("%s at end of expression", message)
+	}
+	return fmt.Errorf("%s at position %d, got %s", message, token.pos, token.text)
+}
+
+func (p *exprParser) parseOr() (claimExpression, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.accept("||") {
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = exprBinary{op: "||", left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *exprParser) parseAnd() (claimExpression, error) {
+	left, err := p.parseNot()
+	if err != nil {
+		return nil, err
+	}
+	for p.accept("&&") {
+		right, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		left = exprBinary{op: "&&", left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *exprParser) parseNot() (claimExpression, error) {
+	if p.accept("!") {
+		operand, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		return exprNot{operand: operand}, nil
+	}
+	return p.parseComparison()
+}
+
+func (p *exprParser) parseComparison() (claimExpression, error) {
+	left, err := p.parsePrimary()
+	if err != nil {
+		return nil, err
+	}
+	for _, op := range []string{"==", "!=", "<=", ">=", "<", ">"} {
+		if p.accept(op) {
+			right, err := p.parsePrimary()
+			if err != nil {
+				return nil, err
+			}
+			return exprBinary{op: op, left: left, right: right}, nil
+		}
+	}
+	return left, nil
+}
+
+func (p *exprParser) parsePrimary() (claimExpression, error) {
+	if p.accept("(") {
+		inner, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		return inner, p.expect(")")
+	}
+	token := p.peek()
+	switch token.kind {
+	case "string", "number":
+		p.next()
+		return exprLiteral{value: token.value}, nil
+	case "ident":
+		p.next()
+		switch token.text {
+		case "true", "false":
+			return exprLiteral{value: token.text == "true"}, nil
+		case "null":
+			return exprLiteral{}, nil
+		case "payload":
+			return p.parseClaim()
+		case "contains":
+			return p.parseContains()
+		}
+		return nil, fmt.Errorf("unknown identifier %s at position %d", token.text, token.pos)
+	}
+	return nil, p.unexpected("expected a value")
+}
+
+func (p *exprParser) parseClaim() (claimExpression, error) {
+	var path []string
+	for {
+		if p.accept(".") {
+			token := p.next()
+			if token.kind != "ident" {
+				p.pos--
+				return nil, p.unexpected("expected a claim name")
+			}
+			path = append(path, token.text)
+		} else if p.accept("[") {
+			token := p.next()
+			if token.kind != "string" {
+				p.pos--
+				return nil, p.unexpected("expected a quoted claim name")
+			}
+			path = append(path, token.value.(string))
+			if err := p.expect("]"); err != nil {
+				return nil, err
+			}
+		} else {
+			break
+		}
+	}
+	if len(path) == 0 {
+		return nil, p.unexpected("expected a claim after payload")
+	}
+	return exprClaim{path: path}, nil
+}
+
+func (p *exprParser) parseContains() (claimExpression, error) {
+	if err := p.expect("("); err != nil {
+		return nil, err
+	}
+	collection, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if err := p.expect(","); err != nil {
+		return nil, err
+	}
+	value, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if err := p.expect(")"); err != nil {
+		return nil, err
+	}
+	return exprContains{collection: collection, value: value}, nil
+}
+
+// claimString formats a decoded JSON claim value as a string. Numbers use their shortest representation (2.0
+// becomes "2"), other non-string values are formatted as JSON.
+func claimString(value interface{}) string {
+	switch v := value.(type) {
+	case string:
+		return v
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case bool:
+		return strconv.FormatBool(v)
+	}
+	b, _ := json.Marshal(value)
+	return string(b)
+}
+
+// claimMatchesAny compares a claim value with an expected value or a list of accepted values
+func claimMatchesAny(value interface{}, expected interface{}) bool {
+	switch accepted := expected.(type) {
+	case []interface{}:
+		for _, e := range accepted {
+			if claimEquals(value, e) {
+				return true
+			}
+		}
+		return false
+	case []string:
+		for _, e := range accepted {
+			if claimEquals(value, e) {
+				return true
+			}
+		}
+		return false
+	}
+	return claimEquals(value, expected)
+}
+
+// claimEquals compares a decoded JSON claim value with a configured value. Configured numbers and booleans
+// may be given as strings, since not every configuration provider preserves their type.
+func claimEquals(value interface{}, expected interface{}) bool {
+	switch v := value.(type) {
+	case string:
+		e, ok := expected.(string)
+		return ok && v == e
+	case bool:
+		switch e := expected.(type) {
+		case bool:
+			return v == e
+		case string:
+			b, err := strconv.ParseBool(e)
+			return err == nil && v == b
+		}
+	case float64:
+		e, ok := toFloat(expected)
+		return ok && v == e
+	}
+	return false
+}
+
+// toFloat converts a configured numeric value to a float64
+func toFloat(value interface{}) (float64, bool) {
+	switch v := value.(type) {
+	case float64:
+		return v, true
+	case float32:
+		return float64(v), true
+	case int:
+		return float64(v), true
+	case int64:
+		return float64(v), true
+	case int32:
+		return float64(v), true
+	case json.Number:
+		f, err := v.Float64()
+		return f, err == nil
+	case string:
+		f, err := strconv.ParseFloat(v, 64)
+		return f, err == nil
+	}
+	return 0, false
+}
+
+func stringSet(values []string) map[string]struct{} {
+	set := make(map[string]struct{}, len(values))
+	for _, v := range values {
+		set[v] = struct{}{}
+	}
+	return set
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// compileIssuerPattern turns an issuer pattern into an anchored regular expression
+func compileIssuerPattern(pattern string) *regexp.Regexp {
+	parts := strings.Split(pattern, "*")
+	for i, part := range parts {
+		parts[i] = regexp.QuoteMeta(part)
+	}
+	return regexp.MustCompile("^" + strings.Join(parts, "[^/]*") + "$")
+}
+
+func (jwtPlugin *JwtPlugin) ExtractToken(request *http.Request) (*JWT, error) {
+	authHeader, ok := request.Header["Authorization"]
+	if !ok {
+		return nil, nil
+	}
+	auth := authHeader[0]
+	if !strings.HasPrefix(auth, "Bearer ") {
+		return nil, nil
+	}
+	return parseToken(auth[7:], nil)
+}
+
+// maxTokenDepth is the maximum number of nested tokens, including the outer token
+const maxTokenDepth = 2
+
+// parseToken parses a compact JWS. When the token header has cty "JWT", the payload is parsed as a nested token
+// and the innermost token is returned, linked to its enclosing tokens through Wrapper.
+func parseToken(compact string, wrapper *JWT) (*JWT, error) {
+	parts := strings.Split(compact, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("invalid token format")
+	}
+	header, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, err
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, err
+	}
+	jwtToken := JWT{
+		Plaintext: []byte(compact[:len(parts[0])+len(parts[1])+1]),
+		Signature: signature,
+		Wrapper:   wrapper,
+		Raw:       compact,
+	}
+	err = json.Unmarshal(header, &jwtToken.Header)
+	if err != nil {
+		return nil, err
+	}
+	var payload []byte
+	if jwtToken.Header.B64 != nil && !*jwtToken.Header.B64 {
+		// RFC 7797: the payload is signed and carried as is. An empty payload is detached, sent apart from the token.
+		if parts[1] == "" {
+			return nil, fmt.Errorf("tokens with a detached payload are not supported")
+		}
+		payload = []byte(parts[1])
+	} else if payload, err = base64.RawURLEncoding.DecodeString(parts[1]); err != nil {
+		return nil, err
+	}
+	if strings.EqualFold(jwtToken.Header.Cty, "JWT") {
+		depth := 1
+		for w := wrapper; w != nil; w = w.Wrapper {
+			depth++
+		}
+		if depth >= maxTokenDepth {
+			return nil, fmt.Errorf("nested token exceeds the maximum depth of %d", maxTokenDepth)
+		}
+		return parseToken(string(payload), &jwtToken)
+	}
+	err = json.Unmarshal(payload, &jwtToken.Payload)
+	if err != nil {
+		return nil, err
+	}
+	return &jwtToken, nil
+}
+
+func (jwtPlugin *JwtPlugin) remoteAddr(req *http.Request) Network {
+	// This will only be defined when site is accessed via non-anonymous proxy
+	// and takes precedence over RemoteAddr
+	// Header.Get is case-insensitive
+	ipHeader := req.Header.Get("X-Forwarded-For")
+	if len(ipHeader) == 0 {
+		ipHeader = req.RemoteAddr
+	}
+
+	ip, port, err := net.SplitHostPort(ipHeader)
+	portNumber, _ := strconv.Atoi(port)
+	if err == nil {
+		return Network{
+			Client: Client{
+				IP:   ip,
+				Port: portNumber,
+			},
+		}
+	}
+
+	userIP := net.ParseIP(ipHeader)
+	if userIP == nil {
+		return Network{
+			Client: Client{
+				IP:   ipHeader,
+				Port: portNumber,
+			},
+		}
+	}
+
+	return Network{
+		Client: Client{
+			IP:   userIP.String(),
+			Port: portNumber,
+		},
+	}
+}
+
+// parseTrustedProxy parses a CIDR of TrustedProxies, or a single IP
+func parseTrustedProxy(proxy string) (*net.IPNet, error) {
+	if _, trusted, err := net.ParseCIDR(proxy); err == nil {
+		return trusted, nil
+	}
+	ip := net.ParseIP(proxy)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid TrustedProxies %s, expecting a CIDR or an IP", proxy)
+	}
+	bits := 8 * net.IPv6len
+	if ip.To4() != nil {
+		ip, bits = ip.To4(), 8*net.IPv4len
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+}
+
+// clientIP returns the IP of the client. When the connection comes from one of the TrustedProxies, X-Forwarded-For
+// is walked from the right, skipping the trusted proxies, and the first untrusted address is the client. Without
+// TrustedProxies, X-Forwarded-For is ignored, as any client can send it.
+func (jwtPlugin *JwtPlugin) clientIP(request *http.Request) string {
+	client := remoteHost(request)
+	if !jwtPlugin.trustedProxy(net.ParseIP(client)) {
+		return client
+	}
+	forwarded := strings.Split(strings.Join(request.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(forwarded[i])
+		if host, _, err := net.SplitHostPort(hop); err == nil {
+			hop = host
+		}
+		ip := net.ParseIP(hop)
+		if ip == nil {
+			// a malformed entry ends the chain, the last trusted proxy is the best known client
+			break
+		}
+		client = ip.String()
+		if !jwtPlugin.trustedProxy(ip) {
+			break
+		}
+	}
+	return client
+}
+
+// jsonValue converts the maps of a configuration value to map[string]interface{}, as YAML and yaegi may provide
+// nested maps with interface{} keys, which cannot be marshalled to JSON
+func jsonValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		converted := make(map[string]interface{}, len(v))
+		for key, item := range v {
+			converted[key] = jsonValue(item)
+		}
+		return converted
+	case map[interface{}]interface{}:
+		converted := make(map[string]interface{}, len(v))
+		for key, item := range v {
+			converted[fmt.Sprint(key)] = jsonValue(item)
+		}
+		return converted
+	case []interface{}:
+		converted := make([]interface{}, len(v))
+		for i, item := range v {
+			converted[i] = jsonValue(item)
+		}
+		return converted
+	}
+	return value
+}
+
+// opaHeadersInput returns the headers of the request for OPA, without the opaHeaderDenylist headers. The headers of
+// the request are not modified.
+func (jwtPlugin *JwtPlugin) opaHeadersInput(header http.Header) http.Header {
+	var headers http.Header
+	for _, name := range jwtPlugin.opaHeaderDenylist {
+		if _, ok := header[http.CanonicalHeaderKey(name)]; !ok {
+			continue
+		}
+		if headers == nil {
+			headers = header.Clone()
+		}
+		headers.Del(name)
+	}
+	if headers == nil {
+		return header
+	}
+	return headers
+}
+
+// cookiesInput returns the cookies of the request for OPA, limited to the OpaCookies when configured
+func (jwtPlugin *JwtPlugin) cookiesInput(request *http.Request) (map[string]string, map[string][]string) {
+	var cookies map[string]string
+	var values map[string][]string
+	for _, cookie := range request.Cookies() {
+		if len(jwtPlugin.opaCookies) > 0 && !containsString(jwtPlugin.opaCookies, cookie.Name) {
+			continue
+		}
+		if cookies == nil {
+			cookies, values = make(map[string]string), make(map[string][]string)
+		}
+		if _, ok := cookies[cookie.Name]; !ok {
+			cookies[cookie.Name] = cookie.Value
+		}
+		values[cookie.Name] = append(values[cookie.Name], cookie.Value)
+	}
+	return cookies, values
+}
+
+// remoteHost returns the host of the RemoteAddr of the request
+func remoteHost(request *http.Request) string {
+	if host, _, err := net.SplitHostPort(request.RemoteAddr); err == nil {
+		return host
+	}
+	return request.RemoteAddr
+}
+
+// requestOrigin returns the scheme and port requested by the client: https for TLS connections, otherwise the
+// X-Forwarded-Proto and X-Forwarded-Port of a trusted proxy, and the port of the Host or the default port of the
+// scheme.
+func (jwtPlugin *JwtPlugin) requestOrigin(request *http.Request) (string, int) {
+	scheme := "http"
+	forwarded := request.TLS == nil && jwtPlugin.trustedProxy(net.ParseIP(remoteHost(request)))
+	if request.TLS != nil {
+		scheme = "https"
+	} else if proto := strings.ToLower(strings.TrimSpace(strings.Split(request.Header.Get("X-Forwarded-Proto"), ",")[0])); forwarded && (proto == "http" || proto == "https") {
+		scheme = proto
+	}
+	if _, port, err := net.SplitHostPort(request.Host); err == nil {
+		if number, err := strconv.Atoi(port); err == nil {
+			return scheme, number
+		}
+	}
+	if port, err := strconv.Atoi(strings.TrimSpace(strings.Split(request.Header.Get("X-Forwarded-Port"), ",")[0])); forwarded && err == nil && port > 0 {
+		return scheme, port
+	}
+	if scheme == "https" {
+		return scheme, 443
+	}
+	return scheme, 80
+}
+
+func (jwtPlugin *JwtPlugin) trustedProxy(ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	for _, trusted := range jwtPlugin.trustedProxies {
+		if trusted.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// VerifyToken verifies the signature of the token. The error describes the failure for the log, clients only get a
+// generic error from checkJwt. When a check fails before the signature is verified, a signature verification is
+// still carried out and its result discarded, so that the timing does not tell which check failed or whether the kid
+// is known.
+func (jwtPlugin *JwtPlugin) VerifyToken(jwtToken *JWT) error {
+	keys, families := jwtPlugin.keys.Snapshot()
+	a := jwtPlugin.algorithms[jwtToken.Header.Alg]
+	err := jwtPlugin.checkTokenHeader(jwtToken)
+	if err == nil && len(keys) == 0 {
+		err = fmt.Errorf("no keys available yet to verify the token")
+	}
+	if err != nil {
+		jwtPlugin.decoyVerify(keys, families, jwtToken)
+		return err
+	}
+	key, ok := keys[jwtToken.Header.Kid]
+	if !ok && looksLikeThumbprint(jwtToken.Header.Kid) {
+		key, ok = jwtPlugin.keys.Thumbprint(jwtToken.Header.Kid)
+	}
+	// tokens identifying their signing certificate, e.g. from ADFS, find the key by its certificate thumbprint
+	for _, thumbprint := range []string{jwtToken.Header.X5tS256, jwtToken.Header.X5t} {
+		if !ok && thumbprint != "" {
+			key, ok = jwtPlugin.keys.Certificate(thumbprint)
+		}
+	}
+	if ok && !jwtPlugin.keyExpired(key) {
+		if !jwtPlugin.keyAllowsAlg(key, jwtToken.Header.Alg) {
+			err = fmt.Errorf("the key of the token does not allow alg %s", jwtToken.Header.Alg)
+		} else if !jwtPlugin.rsaBitsWarn && jwtPlugin.rsaKeyTooSmall(key.key) {
+			err = fmt.Errorf("the RSA key of the token is smaller than %d bits", jwtPlugin.minRsaBits)
+		}
+		if err != nil {
+			jwtPlugin.decoyVerify(keys, families, jwtToken)
+			return err
+		}
+		return a.verify(key.key, a.hash, jwtToken.Plaintext, jwtToken.Signature)
+	} else if jwtPlugin.strictKid || jwtPlugin.isUnknownKid(jwtToken.Header.Kid) {
+		jwtPlugin.decoyVerify(keys, families, jwtToken)
+		return fmt.Errorf("no key found for the kid of the token")
+	} else {
+		jwtPlugin.logKeyEvent("warning", "No key found for the kid of the token, trying all keys", jwtToken.Header.Kid)
+		// only the keys of the alg family are tried, in the order of their kid
+		for _, kid := range families[algFamily(jwtToken.Header.Alg)] {
+			key := keys[kid]
+			if jwtPlugin.keyExpired(key) || !jwtPlugin.keyAllowsAlg(key, jwtToken.Header.Alg) || !jwtPlugin.rsaBitsWarn && jwtPlugin.rsaKeyTooSmall(key.key) {
+				continue
+			}
+			err := a.verify(key.key, a.hash, jwtToken.Plaintext, jwtToken.Signature)
+			if err == nil {
+				return nil
+			}
+		}
+		jwtPlugin.addUnknownKid(jwtToken.Header.Kid)
+		return fmt.Errorf("token validation failed")
+	}
+}
+
+// looksLikeThumbprint reports whether a kid has the form of a base64url encoded SHA-256 RFC 7638 thumbprint, so
+// that it is worth looking up a key stored under another kid by its thumbprint
+func looksLikeThumbprint(kid string) bool {
+	if len(kid) != base64.RawURLEncoding.EncodedLen(sha256.Size) {
+		return false
+	}
+	_, err := base64.RawURLEncoding.DecodeString(kid)
+	return err == nil
+}
+
+// isUnknownKid reports whether the kid recently matched no key and failed the fallback over all keys. A key
+// published under the kid since then is found before this check, so a refresh makes the kid usable again.
+func (jwtPlugin *JwtPlugin) isUnknownKid(kid string) bool {
+	if jwtPlugin.unknownKids == nil || kid == "" {
+		return false
+	}
+	return jwtPlugin.unknownKids.contains(kid, jwtPlugin.now())
+}
+
+// addUnknownKid remembers a kid for the UnknownKidCacheTTL. Tokens without kid are not remembered, as the fallback
+// is the only way to verify them.
+func (jwtPlugin *JwtPlugin) addUnknownKid(kid string) {
+	if jwtPlugin.unknownKids == nil || kid == "" {
+		return
+	}
+	now := jwtPlugin.now()
+	jwtPlugin.unknownKids.add(kid, now.Add(jwtPlugin.unknownKids.ttl), now)
+}
+
+// checkTokenHeader verifies the header of the token before its signature: the kid, the crit and b64 headers and the
+// alg
+func (jwtPlugin *JwtPlugin) checkTokenHeader(jwtToken *JWT) error {
+	if jwtPlugin.requireKid && jwtToken.Header.Kid == "" {
+		return fmt.Errorf("token has no kid header")
+	}
+	if jwtToken.Header.B64 != nil {
+		if !jwtPlugin.unencodedPayload {
+			return fmt.Errorf("tokens with the b64 header (RFC 7797 unencoded payload) are not accepted")
+		}
+		if !containsString(jwtToken.Header.Crit, "b64") {
+			return fmt.Errorf("the b64 header must be listed in crit")
+		}
+	}
+	for _, h := range jwtToken.Header.Crit {
+		if _, ok := supportedHeaderNames[h]; !ok && (h != "b64" || !jwtPlugin.unencodedPayload) {
+			return fmt.Errorf("unsupported header: %s", h)
+		}
+	}
+	if _, ok := jwtPlugin.algorithms[jwtToken.Header.Alg]; !ok {
+		return fmt.Errorf("unknown JWS algorithm: %s", jwtToken.Header.Alg)
+	}
+	if len(jwtPlugin.algs) > 0 && !containsString(jwtPlugin.algs, jwtToken.Header.Alg) {
+		return fmt.Errorf("incorrect alg, expected %s got %s", strings.Join(jwtPlugin.algs, ","), jwtToken.Header.Alg)
+	}
+	return nil
+}
+
+// decoyVerify verifies the signature of a rejected token against a key usable for its alg (HS256 for unknown
+// algorithms), discarding the result, so that a rejection takes about as long as a verification
+func (jwtPlugin *JwtPlugin) decoyVerify(keys map[string]storedKey, families map[string][]string, jwtToken *JWT) {
+	alg := jwtToken.Header.Alg
+	a, ok := jwtPlugin.algorithms[alg]
+	if !ok {
+		alg, a = "HS256", jwtPlugin.algorithms["HS256"]
+	}
+	for _, kid := range families[algFamily(alg)] {
+		if key := keys[kid]; jwtPlugin.keyAllowsAlg(key, alg) {
+			_ = a.verify(key.key, a.hash, jwtToken.Plaintext, jwtToken.Signature)
+			return
+		}
+	}
+	if a.hash.Available() {
+		h := a.hash.New()
+		_, _ = h.Write(jwtToken.Plaintext)
+		h.Sum(nil)
+	}
+}
+
+// checkKeySize verifies that an RSA key has at least MinRsaKeyBits. In the warn mode, smaller keys are only logged.
+func (jwtPlugin *JwtPlugin) checkKeySize(kid string, key interface{}) error {
+	if !jwtPlugin.rsaKeyTooSmall(key) {
+		return nil
+	}
+	err := fmt.Errorf("RSA key %s has %d bits, less than the minimum of %d", kid, key.(*rsa.PublicKey).N.BitLen(), jwtPlugin.minRsaBits)
+	if jwtPlugin.rsaBitsWarn {
+		jwtPlugin.logKeyEvent("warning", err.Error(), kid)
+		return nil
+	}
+	return err
+}
+
+// rsaKeyTooSmall reports whether a key is an RSA key with fewer than MinRsaKeyBits
+func (jwtPlugin *JwtPlugin) rsaKeyTooSmall(key interface{}) bool {
+	rsaKey, ok := key.(*rsa.PublicKey)
+	return ok && jwtPlugin.minRsaBits > 0 && rsaKey.N.BitLen() < jwtPlugin.minRsaBits
+}
+
+// keyAllowsAlg reports whether a key may verify a token with the alg: the type of the key must suit the algorithm
+// family, so that only symmetric secrets are ever used for HMAC and public keys are never used as an HMAC secret
+// (algorithm confusion), and the alg declared by a JWKS key must match according to the KeyAlgMatch.
+func (jwtPlugin *JwtPlugin) keyAllowsAlg(key storedKey, alg string) bool {
+	family := algFamily(alg)
+	if !containsString(keyFamilies(key.key), family) {
+		return false
+	}
+	if key.alg == "" || key.alg == alg {
+		return true
+	}
+	return jwtPlugin.keyAlgFamily && algFamily(key.alg) == family
+}
+
+// algFamily returns the family of a JWS algorithm: RS, PS, ES, HS or EdDSA
+func algFamily(alg string) string {
+	if alg == "EdDSA" || len(alg) < 2 {
+		return alg
+	}
+	return alg[:2]
+}
+
+func (jwtPlugin *JwtPlugin) CheckOpa(request *http.Request, token *JWT, authMethod string) error {
+	_, err := jwtPlugin.checkOpa(request, token, authMethod)
+	return err
+}
+
+// checkOpa queries OPA, returning the headers to set on the response when the request is allowed
+func (jwtPlugin *JwtPlugin) checkOpa(request *http.Request, token *JWT, authMethod string) (map[string]string, error) {
+	cacheKey := jwtPlugin.opaCacheKey(request, token, authMethod)
+	if jwtPlugin.opaFailOpen {
+		// only the plugin tells the backend that OPA was bypassed
+		request.Header.Del(opaBypassedHeader)
+	}
+	result, cached := jwtPlugin.opaCache.get(cacheKey, jwtPlugin.now())
+	if !cached {
+		var err error
+		if result, err = jwtPlugin.queryOpa(request, token, authMethod); err != nil {
+			if failure, ok := err.(opaError); ok && jwtPlugin.opaFailOpen && failure.unreachable() {
+				jwtPlugin.logRequestEvent(request, "warning", fmt.Sprintf("Allowing the request without OPA decision (OpaFailureMode open): %v", failure), authMethod)
+				request.Header.Set(opaBypassedHeader, "true")
+				return map[string]string{opaBypassedHeader: "true"}, nil
+			}
+			return nil, err
+		}
+	}
+	allowField, ok := opaResultField(result, jwtPlugin.opaAllowField)
+	if !ok {
+		return nil, fmt.Errorf("OPA result has no field %s", jwtPlugin.opaAllowField)
+	}
+	var allow bool
+	if err := json.Unmarshal(allowField, &allow); err != nil {
+		return nil, fmt.Errorf("OPA result field %s is not a boolean", jwtPlugin.opaAllowField)
+	}
+	if !cached && cacheKey != "" && (allow || jwtPlugin.opaCacheDeny) {
+		jwtPlugin.opaCache.add(cacheKey, result, jwtPlugin.now())
+	}
+	var responseHeaders map[string]string
+	if jwtPlugin.opaResponseHeadersField != "" && (!allow || jwtPlugin.opaResponseHeadersOnAllow) {
+		responseHeaders, _ = jwtPlugin.opaResultHeaders(request, result, jwtPlugin.opaResponseHeadersField, authMethod)
+	}
+	if !allow {
+		denial := jwtPlugin.opaDenial(result)
+		denial.headers = responseHeaders
+		return nil, denial
+	}
+	for k, v := range jwtPlugin.opaHeaders {
+		var value string
+		if field, ok := opaResultField(result, v); ok && json.Unmarshal(field, &value) == nil {
+			request.Header.Add(k, value) // add OPA result as an HTTP header
 		}
 	}
-	if jwtPlugin.opaUrl != "" {
-		if err := jwtPlugin.CheckOpa(request, jwtToken); err != nil {
-			return err
+	if jwtPlugin.opaHeadersField != "" {
+		headers, skipped := jwtPlugin.opaResultHeaders(request, result, jwtPlugin.opaHeadersField, authMethod)
+		for name, value := range headers {
+			request.Header.Set(name, value)
+		}
+		// headers whose value OPA failed to set are not left to the client
+		for _, name := range skipped {
+			request.Header.Del(name)
 		}
 	}
-	return nil
+	return responseHeaders, nil
 }
 
-func (jwtPlugin *JwtPlugin) ExtractToken(request *http.Request) (*JWT, error) {
-	authHeader, ok := request.Header["Authorization"]
-	if !ok {
-		return nil, nil
-	}
-	auth := authHeader[0]
-	if !strings.HasPrefix(auth, "Bearer ") {
-		return nil, nil
-	}
-	parts := strings.Split(auth[7:], ".")
-	if len(parts) != 3 {
-		return nil, fmt.Errorf("invalid token format")
+// queryOpa sends the input of a request to OPA and returns the result
+func (jwtPlugin *JwtPlugin) queryOpa(request *http.Request, token *JWT, authMethod string) (map[string]json.RawMessage, error) {
+	var opaPayload *Payload
+	var err error
+	if jwtPlugin.opaIncludeBody {
+		opaPayload, err = jwtPlugin.toOPAPayloadWithBody(request)
+	} else {
+		opaPayload, err = toOPAPayload(request)
 	}
-	header, err := base64.RawURLEncoding.DecodeString(parts[0])
 	if err != nil {
 		return nil, err
 	}
-	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	opaPayload.Input.AuthMethod = authMethod
+	opaPayload.Input.Context = jwtPlugin.opaExtraInput
+	opaPayload.Input.Middleware, opaPayload.Input.RouteName = jwtPlugin.name, jwtPlugin.routeName
+	opaPayload.Input.TLS = jwtPlugin.tlsInput(request)
+	opaPayload.Input.Cookies, opaPayload.Input.CookieValues = jwtPlugin.cookiesInput(request)
+	opaPayload.Input.Headers = jwtPlugin.opaHeadersInput(request.Header)
+	opaPayload.Input.ClientIP = jwtPlugin.clientIP(request)
+	opaPayload.Input.RemoteAddr = request.RemoteAddr
+	opaPayload.Input.Scheme, opaPayload.Input.Port = jwtPlugin.requestOrigin(request)
+	opaPayload.Input.URL = opaPayload.Input.Scheme + "://" + request.Host + request.URL.RequestURI()
+	if token != nil {
+		opaPayload.Input.JWTHeader = token.Header
+		opaPayload.Input.JWTPayload = token.Payload
+		if jwtPlugin.opaIncludeTokenRaw {
+			// the outermost token of a nested token is the one sent by the client
+			outer := token
+			for outer.Wrapper != nil {
+				outer = outer.Wrapper
+			}
+			opaPayload.Input.TokenRaw = outer.Raw
+		}
+	}
+	authPayloadAsJSON, err := json.Marshal(opaPayload)
 	if err != nil {
 		return nil, err
 	}
-	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	// the query is cancelled when the client goes away
+	ctx, cancel := context.WithTimeout(request.Context(), jwtPlugin.opaTimeout)
+	defer cancel()
+	backoff := jwtPlugin.opaRetryBackoff
+	for attempt := 0; ; attempt++ {
+		result, status, err := jwtPlugin.postOpa(ctx, authPayloadAsJSON)
+		if err == nil {
+			return result, nil
+		}
+		// a response which OPA answered with a decision or an error of its own is final
+		if !transientOpaStatus(status) || attempt >= jwtPlugin.opaRetries || ctx.Err() != nil {
+			return nil, jwtPlugin.opaFailure(request, err, status, authMethod)
+		}
+		// a retry which cannot complete before the deadline is not attempted
+		if deadline, ok := ctx.Deadline(); ok && time.Now().Add(backoff).After(deadline) {
+			return nil, jwtPlugin.opaFailure(request, err, status, authMethod)
+		}
+		jwtPlugin.logRequestEvent(request, "debug", fmt.Sprintf("Retrying the OPA query in %s after attempt %d failed: %v", backoff, attempt+1, err), authMethod)
+		select {
+		case <-ctx.Done():
+			return nil, jwtPlugin.opaFailure(request, err, status, authMethod)
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+// postOpa sends an input to OPA, returning the result of the response or an error with the status of the response.
+// The status is 0 when no response was received.
+func (jwtPlugin *JwtPlugin) postOpa(ctx context.Context, input []byte) (map[string]json.RawMessage, int, error) {
+	authRequest, err := http.NewRequestWithContext(ctx, http.MethodPost, jwtPlugin.opaUrl, bytes.NewReader(input))
 	if err != nil {
-		return nil, err
+		return nil, 0, err
 	}
-	jwtToken := JWT{
-		Plaintext: []byte(auth[7 : len(parts[0])+len(parts[1])+8]),
-		Signature: signature,
+	authRequest.Header.Set("Content-Type", "application/json")
+	for name, value := range jwtPlugin.opaRequestHeaders {
+		authRequest.Header.Set(name, value)
 	}
-	err = json.Unmarshal(header, &jwtToken.Header)
+	authResponse, err := jwtPlugin.opaClient.Do(authRequest)
 	if err != nil {
-		return nil, err
+		return nil, 0, err
 	}
-	err = json.Unmarshal(payload, &jwtToken.Payload)
+	defer authResponse.Body.Close()
+	body, err := ioutil.ReadAll(authResponse.Body)
 	if err != nil {
-		return nil, err
+		return nil, authResponse.StatusCode, err
 	}
-	return &jwtToken, nil
+	if authResponse.StatusCode != http.StatusOK {
+		return nil, authResponse.StatusCode, fmt.Errorf("OPA responded with status %d", authResponse.StatusCode)
+	}
+	var result Response
+	if err = json.Unmarshal(body, &result); err != nil {
+		return nil, authResponse.StatusCode, fmt.Errorf("invalid OPA response: %v", err)
+	}
+	return result.Result, authResponse.StatusCode, nil
 }
 
-func (jwtPlugin *JwtPlugin) remoteAddr(req *http.Request) Network {
-	// This will only be defined when site is accessed via non-anonymous proxy
-	// and takes precedence over RemoteAddr
-	// Header.Get is case-insensitive
-	ipHeader := req.Header.Get("X-Forwarded-For")
-	if len(ipHeader) == 0 {
-		ipHeader = req.RemoteAddr
-	}
+// opaBypassedHeader is set on the request and its response when the OpaFailureMode open allowed a request without
+// OPA decision
+const opaBypassedHeader = "X-Opa-Bypassed"
 
-	ip, port, err := net.SplitHostPort(ipHeader)
-	portNumber, _ := strconv.Atoi(port)
-	if err == nil {
-		return Network{
-			Client: Client{
-				IP:   ip,
-				Port: portNumber,
-			},
-		}
-	}
+// opaError is a failed OPA query, as opposed to a denial of the request by OPA
+type opaError struct {
+	err     error
+	timeout bool
+	// status is the status of an OPA response which is not a decision
+	status int
+}
 
-	userIP := net.ParseIP(ipHeader)
-	if userIP == nil {
-		return Network{
-			Client: Client{
-				IP:   ipHeader,
-				Port: portNumber,
-			},
-		}
+// unreachable reports whether OPA could not be reached or timed out, or a gateway in front of OPA failed
+func (e opaError) unreachable() bool {
+	return e.timeout || transientOpaStatus(e.status)
+}
+
+// transientOpaStatus reports whether the status of a failed OPA query is worth a retry: 0 when no response was
+// received, or a failure of a gateway in front of OPA
+func transientOpaStatus(status int) bool {
+	return status == 0 || status == http.StatusBadGateway || status == http.StatusServiceUnavailable || status == http.StatusGatewayTimeout
+}
+
+func (e opaError) Error() string {
+	if e.timeout {
+		return fmt.Sprintf("OPA query timed out: %v", e.err)
 	}
+	return fmt.Sprintf("OPA query failed: %v", e.err)
+}
 
-	return Network{
-		Client: Client{
-			IP:   userIP.String(),
-			Port: portNumber,
-		},
+// errClientCanceled is returned for an OPA query which was cancelled because the client went away
+var errClientCanceled = fmt.Errorf("the client cancelled the request")
+
+// opaFailure counts and logs a failed OPA query, telling timeouts from other failures. A query cancelled because
+// the client went away is not an OPA failure, and is neither counted nor logged.
+func (jwtPlugin *JwtPlugin) opaFailure(request *http.Request, err error, status int, authMethod string) error {
+	if request.Context().Err() == context.Canceled {
+		return errClientCanceled
+	}
+	failure := opaError{err: err, status: status}
+	if timeout, ok := err.(interface{ Timeout() bool }); ok && timeout.Timeout() {
+		failure.timeout = true
 	}
+	event := LogEvent{Level: "error", Msg: failure.Error(), Time: jwtPlugin.now(), Network: jwtPlugin.remoteAddr(request), URL: request.URL.String(), AuthMethod: authMethod}
+	if failure.timeout {
+		event.OpaFailure, event.OpaFailureCount = "timeout", atomic.AddUint64(&jwtPlugin.opaTimeouts, 1)
+	} else {
+		event.OpaFailure, event.OpaFailureCount = "error", atomic.AddUint64(&jwtPlugin.opaErrors, 1)
+	}
+	jsonLogEvent, _ := json.Marshal(&event)
+	_, _ = fmt.Fprintln(jwtPlugin.logWriter, string(jsonLogEvent))
+	return failure
 }
 
-func (jwtPlugin *JwtPlugin) VerifyToken(jwtToken *JWT) error {
-	for _, h := range jwtToken.Header.Crit {
-		if _, ok := supportedHeaderNames[h]; !ok {
-			return fmt.Errorf("unsupported header: %s", h)
-		}
+// opaCacheKey returns the key of the OPA decision of a request in the opaCache, or "" when the decision is not
+// cached: without cache, with OpaIncludeBody and for requests without token
+func (jwtPlugin *JwtPlugin) opaCacheKey(request *http.Request, token *JWT, authMethod string) string {
+	if jwtPlugin.opaCache == nil || jwtPlugin.opaIncludeBody || token == nil {
+		return ""
 	}
-	// Look up the algorithm
-	a, ok := tokenAlgorithms[jwtToken.Header.Alg]
-	if !ok {
-		return fmt.Errorf("unknown JWS algorithm: %s", jwtToken.Header.Alg)
+	outer := token
+	for outer.Wrapper != nil {
+		outer = outer.Wrapper
 	}
-	if jwtPlugin.alg != "" && jwtToken.Header.Alg != jwtPlugin.alg {
-		return fmt.Errorf("incorrect alg, expected %s got %s", jwtPlugin.alg, jwtToken.Header.Alg)
+	hash := sha256.New()
+	fields := []string{outer.Raw, authMethod, request.Host, request.Method, path.Clean("/" + request.URL.Path), request.URL.Query().Encode()}
+	for _, name := range jwtPlugin.opaCacheKeyHeaders {
+		fields = append(fields, strings.Join(request.Header.Values(name), ","))
 	}
-	key, ok := jwtPlugin.keys[jwtToken.Header.Kid]
-	if ok {
-		return a.verify(key, a.hash, jwtToken.Plaintext, jwtToken.Signature)
-	} else {
-		for _, key := range jwtPlugin.keys {
-			err := a.verify(key, a.hash, jwtToken.Plaintext, jwtToken.Signature)
-			if err == nil {
-				return nil
-			}
-		}
-		return fmt.Errorf("token validation failed")
+	for _, field := range fields {
+		// the length prefix keeps the fields apart
+		_, _ = fmt.Fprintf(hash, "%d:%s", len(field), field)
 	}
+	return string(hash.Sum(nil))
 }
 
-func (jwtPlugin *JwtPlugin) CheckOpa(request *http.Request, token *JWT) error {
-	opaPayload, err := toOPAPayload(request)
-	if err != nil {
-		return err
+// opaDecisionCache remembers the OPA results of requests for the OpaCacheTTL. As all entries have the same TTL, the
+// insertion order is the expiry order: expired entries are dropped from the front, and when the cache is full the
+// oldest entry is evicted.
+type opaDecisionCache struct {
+	lock    sync.Mutex
+	size    int
+	ttl     time.Duration
+	entries map[string]*list.Element
+	order   *list.List
+}
+
+type opaDecisionEntry struct {
+	key    string
+	result map[string]json.RawMessage
+	expiry time.Time
+}
+
+func newOpaDecisionCache(size int, ttl time.Duration) *opaDecisionCache {
+	return &opaDecisionCache{
+		size:    size,
+		ttl:     ttl,
+		entries: make(map[string]*list.Element),
+		order:   list.New(),
 	}
-	if token != nil {
-		opaPayload.Input.JWTHeader = token.Header
-		opaPayload.Input.JWTPayload = token.Payload
+}
+
+// get returns the cached result of a key which has not expired yet
+func (cache *opaDecisionCache) get(key string, now time.Time) (map[string]json.RawMessage, bool) {
+	if cache == nil || key == "" {
+		return nil, false
 	}
-	authPayloadAsJSON, err := json.Marshal(opaPayload)
-	if err != nil {
-		return err
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+	element, ok := cache.entries[key]
+	if !ok || !now.Before(element.Value.(*opaDecisionEntry).expiry) {
+		return nil, false
 	}
-	authResponse, err := http.Post(jwtPlugin.opaUrl, "application/json", bytes.NewBuffer(authPayloadAsJSON))
-	if err != nil {
-		return err
+	return element.Value.(*opaDecisionEntry).result, true
+}
+
+// add records the result of a key for the TTL of the cache
+func (cache *opaDecisionCache) add(key string, result map[string]json.RawMessage, now time.Time) {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+	if element, ok := cache.entries[key]; ok {
+		cache.remove(element)
 	}
-	body, err := ioutil.ReadAll(authResponse.Body)
-	if err != nil {
-		return err
+	for front := cache.order.Front(); front != nil && !now.Before(front.Value.(*opaDecisionEntry).expiry); front = cache.order.Front() {
+		cache.remove(front)
 	}
-	var result Response
-	err = json.Unmarshal(body, &result)
-	if err != nil {
-		return err
+	if cache.order.Len() >= cache.size {
+		cache.remove(cache.order.Front())
 	}
-	var allow bool
+	cache.entries[key] = cache.order.PushBack(&opaDecisionEntry{key: key, result: result, expiry: now.Add(cache.ttl)})
+}
 
-	if err = json.Unmarshal(result.Result[jwtPlugin.opaAllowField], &allow); err != nil {
-		return err
+func (cache *opaDecisionCache) remove(element *list.Element) {
+	delete(cache.entries, element.Value.(*opaDecisionEntry).key)
+	cache.order.Remove(element)
+}
+
+// opaResultHeaders returns the headers of an object of header names to values in the OPA result, together with the
+// names of the headers which are skipped and logged because their value is not a string
+func (jwtPlugin *JwtPlugin) opaResultHeaders(request *http.Request, result map[string]json.RawMessage, fieldName string, authMethod string) (map[string]string, []string) {
+	field, ok := opaResultField(result, fieldName)
+	if !ok || string(field) == "null" {
+		return nil, nil
 	}
-	if !allow {
-		return fmt.Errorf("%s", body)
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(field, &fields); err != nil {
+		jwtPlugin.logRequestEvent(request, "warning", fmt.Sprintf("OPA result field %s is not an object of headers", fieldName), authMethod)
+		return nil, nil
 	}
-	for k, v := range jwtPlugin.opaHeaders {
+	headers := make(map[string]string)
+	var skipped []string
+	for name, raw := range fields {
 		var value string
-		if err = json.Unmarshal(result.Result[v], &value); err == nil {
-			request.Header.Add(k, value) // add OPA result as an HTTP header
+		if err := json.Unmarshal(raw, &value); err != nil {
+			jwtPlugin.logRequestEvent(request, "warning", fmt.Sprintf("Skipping OPA header %s, its value is not a string", name), authMethod)
+			skipped = append(skipped, name)
+			continue
 		}
+		headers[name] = value
 	}
-	return nil
+	return headers, skipped
 }
 
-func toOPAPayload(request *http.Request) (*Payload, error) {
-	input := &PayloadInput{
-		Host:       request.Host,
-		Method:     request.Method,
-		Path:       strings.Split(request.URL.Path, "/")[1:],
-		Parameters: request.URL.Query(),
-		Headers:    request.Header,
+// opaDenial is the response to a request denied by OPA
+type opaDenial struct {
+	status      int
+	contentType string
+	body        []byte
+	// headers are the OpaResponseHeadersField headers of the OPA result
+	headers map[string]string
+}
+
+func (denial opaDenial) Error() string {
+	return string(denial.body)
+}
+
+// opaDenial returns the response to a denied request: the status and body of the OpaHttpStatusField and
+// OpaBodyField of the OPA result when present, otherwise the OpaDenyStatus with its status text. The body field is
+// sent as text when it is a string, otherwise as JSON.
+func (jwtPlugin *JwtPlugin) opaDenial(result map[string]json.RawMessage) opaDenial {
+	denial := opaDenial{status: jwtPlugin.opaDenyStatus}
+	if field, ok := opaResultField(result, jwtPlugin.opaStatusField); jwtPlugin.opaStatusField != "" && ok {
+		var status int
+		if err := json.Unmarshal(field, &status); err == nil && denialStatus(status) {
+			denial.status = status
+		}
+	}
+	denial.contentType, denial.body = "text/plain; charset=utf-8", []byte(http.StatusText(denial.status)+"\n")
+	if field, ok := opaResultField(result, jwtPlugin.opaBodyField); jwtPlugin.opaBodyField != "" && ok && string(field) != "null" {
+		var text string
+		if err := json.Unmarshal(field, &text); err == nil {
+			denial.body = []byte(text)
+		} else {
+			denial.contentType, denial.body = "application/json", field
+		}
+	}
+	return denial
+}
+
+// denialStatus reports whether a status can be used for a denied request: a redirection, client or server error
+func denialStatus(status int) bool {
+	return status >= 300 && status <= 599
+}
+
+// opaResultField returns a field of the OPA result by its dot-separated path, e.g. authz.allow for a decision
+// grouped in an object. A top-level field whose name contains dots is found by its full name first.
+func opaResultField(result map[string]json.RawMessage, path string) (json.RawMessage, bool) {
+	if field, ok := result[path]; ok {
+		return field, true
+	}
+	names := strings.Split(path, ".")
+	field, ok := result[names[0]]
+	for _, name := range names[1:] {
+		var object map[string]json.RawMessage
+		if !ok || json.Unmarshal(field, &object) != nil {
+			return nil, false
+		}
+		field, ok = object[name]
 	}
+	return field, ok
+}
+
+func toOPAPayload(request *http.Request) (*Payload, error) {
+	input := payloadInput(request)
 	contentType, params, err := mime.ParseMediaType(request.Header.Get("Content-Type"))
 	if err == nil {
 		var save []byte
@@ -525,29 +5472,122 @@ func toOPAPayload(request *http.Request) (*Payload, error) {
 				if err != nil {
 					return nil, err
 				}
-			} else if contentType == "application/x-www-url-formencoded" {
-				input.Form, err = url.ParseQuery(string(save))
-				if err != nil {
-					return nil, err
-				}
-			} else if contentType == "multipart/form-data" || contentType == "multipart/mixed" {
-				boundary := params["boundary"]
-				mr := multipart.NewReader(bytes.NewReader(save), boundary)
-				f, err := mr.ReadForm(32 << 20)
-				if err != nil {
-					return nil, err
-				}
-
-				input.Form = make(url.Values)
-				for k, v := range f.Value {
-					input.Form[k] = append(input.Form[k], v...)
-				}
+			} else if err = parseFormBody(input, contentType, params, save); err != nil {
+				return nil, err
 			}
 		}
 	}
 	return &Payload{Input: input}, nil
 }
 
+// tlsInput describes the TLS connection of the request for OPA. Plain HTTP requests have none, unless the client
+// certificate is forwarded by Traefik and the header is trusted (TrustForwardedHeader).
+func (jwtPlugin *JwtPlugin) tlsInput(request *http.Request) *PayloadTLS {
+	var input *PayloadTLS
+	var certs []*x509.Certificate
+	if request.TLS != nil {
+		input = &PayloadTLS{Version: tlsVersionName(request.TLS.Version), CipherSuite: tls.CipherSuiteName(request.TLS.CipherSuite)}
+		certs = request.TLS.PeerCertificates
+	} else if header := request.Header.Get("X-Forwarded-Tls-Client-Cert"); jwtPlugin.trustCertHeader && header != "" {
+		var err error
+		if certs, err = parseForwardedCertificates(header); err != nil {
+			return nil
+		}
+		input = &PayloadTLS{Forwarded: true}
+	}
+	for _, cert := range certs {
+		fingerprint := sha256.Sum256(cert.Raw)
+		input.PeerCertificates = append(input.PeerCertificates, PayloadCertificate{
+			Subject:           cert.Subject.String(),
+			Issuer:            cert.Issuer.String(),
+			DNSNames:          cert.DNSNames,
+			FingerprintSHA256: hex.EncodeToString(fingerprint[:]),
+			NotAfter:          cert.NotAfter,
+		})
+	}
+	return input
+}
+
+func tlsVersionName(version uint16) string {
+	switch version {
+	case tls.VersionTLS10:
+		return "TLS 1.0"
+	case tls.VersionTLS11:
+		return "TLS 1.1"
+	case tls.VersionTLS12:
+		return "TLS 1.2"
+	case tls.VersionTLS13:
+		return "TLS 1.3"
+	}
+	return fmt.Sprintf("0x%04X", version)
+}
+
+func payloadInput(request *http.Request) *PayloadInput {
+	return &PayloadInput{
+		Host:       request.Host,
+		Method:     request.Method,
+		Path:       strings.Split(request.URL.Path, "/")[1:],
+		Parameters: request.URL.Query(),
+		Headers:    request.Header,
+	}
+}
+
+// parseFormBody sets the Form of the input for URL encoded and multipart bodies
+func parseFormBody(input *PayloadInput, contentType string, params map[string]string, body []byte) error {
+	var err error
+	if contentType == "application/x-www-url-formencoded" || contentType == "application/x-www-form-urlencoded" {
+		input.Form, err = url.ParseQuery(string(body))
+		if err != nil {
+			return err
+		}
+	} else if contentType == "multipart/form-data" || contentType == "multipart/mixed" {
+		boundary := params["boundary"]
+		mr := multipart.NewReader(bytes.NewReader(body), boundary)
+		f, err := mr.ReadForm(32 << 20)
+		if err != nil {
+			return err
+		}
+
+		input.Form = make(url.Values)
+		for k, v := range f.Value {
+			input.Form[k] = append(input.Form[k], v...)
+		}
+	}
+	return nil
+}
+
+// toOPAPayloadWithBody creates the OPA input of the OpaIncludeBody mode. At most OpaMaxBodySize bytes of the body
+// are read, and the body is restored for the upstream. A JSON object is sent as the body, anything else as the
+// rawBody string. A larger body is either denied, or sent truncated as rawBody with bodyTruncated set.
+func (jwtPlugin *JwtPlugin) toOPAPayloadWithBody(request *http.Request) (*Payload, error) {
+	input := payloadInput(request)
+	if request.Body == nil || request.Body == http.NoBody {
+		return &Payload{Input: input}, nil
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(request.Body, int64(jwtPlugin.opaMaxBodySize)+1))
+	if err != nil {
+		return nil, err
+	}
+	request.Body = NopCloser(io.MultiReader(bytes.NewReader(data), request.Body), request.Body)
+	if len(data) > jwtPlugin.opaMaxBodySize {
+		if jwtPlugin.opaBodyLimitDeny {
+			return nil, opaDenial{status: http.StatusRequestEntityTooLarge, contentType: "text/plain; charset=utf-8", body: []byte(http.StatusText(http.StatusRequestEntityTooLarge) + "\n")}
+		}
+		input.RawBody, input.BodyTruncated = string(data[:jwtPlugin.opaMaxBodySize]), true
+		return &Payload{Input: input}, nil
+	}
+	contentType, params, _ := mime.ParseMediaType(request.Header.Get("Content-Type"))
+	if (contentType == "application/json" || strings.HasSuffix(contentType, "+json")) && json.Unmarshal(data, &input.Body) == nil {
+		return &Payload{Input: input}, nil
+	}
+	input.Body = nil
+	input.RawBody = string(data)
+	if err := parseFormBody(input, contentType, params, data); err != nil {
+		input.Form = nil
+	}
+	return &Payload{Input: input}, nil
+}
+
 func drainBody(b io.ReadCloser) ([]byte, io.ReadCloser, error) {
 	if b == nil || b == http.NoBody {
 		// No copying needed. Preserve the magic sentinel meaning of NoBody.
@@ -592,17 +5632,20 @@ var tokenAlgorithms = map[string]tokenAlgorithm{
 	"ES256": {crypto.SHA256, verifyAsymmetric(verifyECDSA)},
 	"ES384": {crypto.SHA384, verifyAsymmetric(verifyECDSA)},
 	"ES512": {crypto.SHA512, verifyAsymmetric(verifyECDSA)},
+	"EdDSA": {0, verifyEd25519},
 	"HS256": {crypto.SHA256, verifyHMAC},
 	"HS384": {crypto.SHA384, verifyHMAC},
 	"HS512": {crypto.SHA512, verifyHMAC},
 }
 
-// errSignatureNotVerified is returned when a signature cannot be verified.
 func verifyHMAC(key interface{}, hash crypto.Hash, payload []byte, signature []byte) error {
 	macKey, ok := key.([]byte)
 	if !ok {
 		return fmt.Errorf("incorrect symmetric key type")
 	}
+	if len(signature) != hash.Size() {
+		return fmt.Errorf("invalid HMAC signature length %d, expected %d", len(signature), hash.Size())
+	}
 	mac := hmac.New(hash.New, macKey)
 	if _, err := mac.Write(payload); err != nil {
 		return err
@@ -626,7 +5669,13 @@ func verifyAsymmetric(verify tokenVerifyAsymmetricFunction) tokenVerifyFunction
 }
 
 func verifyRSAPKCS(key interface{}, hash crypto.Hash, digest []byte, signature []byte) error {
-	publicKeyRsa := key.(*rsa.PublicKey)
+	publicKeyRsa, ok := key.(*rsa.PublicKey)
+	if !ok {
+		return fmt.Errorf("incorrect public key type")
+	}
+	if err := checkRSASignatureLength(publicKeyRsa, signature); err != nil {
+		return err
+	}
 	if err := rsa.VerifyPKCS1v15(publicKeyRsa, hash, digest, signature); err != nil {
 		return fmt.Errorf("token verification failed (RSAPKCS)")
 	}
@@ -638,19 +5687,125 @@ func verifyRSAPSS(key interface{}, hash crypto.Hash, digest []byte, signature []
 	if !ok {
 		return fmt.Errorf("incorrect public key type")
 	}
+	if err := checkRSASignatureLength(publicKeyRsa, signature); err != nil {
+		return err
+	}
 	if err := rsa.VerifyPSS(publicKeyRsa, hash, digest, signature, nil); err != nil {
 		return fmt.Errorf("token verification failed (RSAPSS)")
 	}
 	return nil
 }
 
+// checkRSASignatureLength verifies that an RSA signature has the size of the modulus, as required by RFC 8017
+func checkRSASignatureLength(key *rsa.PublicKey, signature []byte) error {
+	if len(signature) != key.Size() {
+		return fmt.Errorf("invalid RSA signature length %d, expected %d", len(signature), key.Size())
+	}
+	return nil
+}
+
+func verifyEd25519(key interface{}, _ crypto.Hash, payload []byte, signature []byte) error {
+	publicKeyEd25519, ok := key.(ed25519.PublicKey)
+	if !ok {
+		return fmt.Errorf("incorrect public key type")
+	}
+	if !ed25519.Verify(publicKeyEd25519, payload, signature) {
+		return fmt.Errorf("token verification failed (EdDSA)")
+	}
+	return nil
+}
+
+// verifyRSAPSSSaltLength returns a PSS verification which requires the salt length, or the size of the hash for
+// rsa.PSSSaltLengthEqualsHash. The rsa package treats a salt length of 0 as auto-detection, so the signature is
+// verified with auto-detection and the salt length is then recovered from the encoded message.
+func verifyRSAPSSSaltLength(saltLength int) tokenVerifyAsymmetricFunction {
+	return func(key interface{}, hash crypto.Hash, digest []byte, signature []byte) error {
+		if err := verifyRSAPSS(key, hash, digest, signature); err != nil {
+			return err
+		}
+		expected := saltLength
+		if expected == rsa.PSSSaltLengthEqualsHash {
+			expected = hash.Size()
+		}
+		if actual := pssSaltLength(key.(*rsa.PublicKey), hash, signature); actual != expected {
+			return fmt.Errorf("token verification failed (RSAPSS salt length %d, expected %d)", actual, expected)
+		}
+		return nil
+	}
+}
+
+// pssSaltLength recovers the salt length of a verified PSS signature from its EMSA-PSS encoded message (RFC 8017
+// section 9.1.2)
+func pssSaltLength(key *rsa.PublicKey, hash crypto.Hash, signature []byte) int {
+	m := new(big.Int).Exp(new(big.Int).SetBytes(signature), big.NewInt(int64(key.E)), key.N)
+	emBits := key.N.BitLen() - 1
+	em := m.FillBytes(make([]byte, (emBits+7)/8))
+	hLen := hash.Size()
+	db := em[:len(em)-hLen-1]
+	h := em[len(em)-hLen-1 : len(em)-1]
+	// MGF1 unmasking of the data block
+	for counter, offset := uint32(0), 0; offset < len(db); counter++ {
+		digest := hash.New()
+		digest.Write(h)
+		digest.Write([]byte{byte(counter >> 24), byte(counter >> 16), byte(counter >> 8), byte(counter)})
+		for _, b := range digest.Sum(nil) {
+			if offset < len(db) {
+				db[offset] ^= b
+				offset++
+			}
+		}
+	}
+	db[0] &= 0xff >> uint(8*len(em)-emBits)
+	for i, b := range db {
+		if b != 0 {
+			return len(db) - i - 1
+		}
+	}
+	return -1
+}
+
+// verifyECDSAOrDer verifies an ECDSA signature in the R||S form, or else as an ASN.1 DER encoded SEQUENCE of r and s,
+// as produced by some client libraries
+func verifyECDSAOrDer(key interface{}, hash crypto.Hash, digest []byte, signature []byte) error {
+	publicKeyEcdsa, ok := key.(*ecdsa.PublicKey)
+	if !ok {
+		return fmt.Errorf("incorrect public key type")
+	}
+	if len(signature) < 8 || signature[0] != 0x30 {
+		return verifyECDSA(key, hash, digest, signature)
+	}
+	// a DER signature may have the length of an R||S signature, so the R||S form is tried first
+	n := (publicKeyEcdsa.Curve.Params().BitSize + 7) / 8
+	if len(signature) == 2*n && verifyECDSA(key, hash, digest, signature) == nil {
+		return nil
+	}
+	// a SEQUENCE of two INTEGERs of at most n+1 bytes, with a long form length for P-521
+	if len(signature) > 2*(n+3)+3 {
+		return fmt.Errorf("invalid DER encoded ECDSA signature length %d", len(signature))
+	}
+	var der struct {
+		R, S *big.Int
+	}
+	if rest, err := asn1.Unmarshal(signature, &der); err != nil || len(rest) > 0 || der.R.Sign() <= 0 || der.S.Sign() <= 0 {
+		return fmt.Errorf("invalid DER encoded ECDSA signature")
+	}
+	if ecdsa.Verify(publicKeyEcdsa, digest, der.R, der.S) {
+		return nil
+	}
+	return fmt.Errorf("token verification failed (ECDSA)")
+}
+
 func verifyECDSA(key interface{}, _ crypto.Hash, digest []byte, signature []byte) error {
 	publicKeyEcdsa, ok := key.(*ecdsa.PublicKey)
 	if !ok {
 		return fmt.Errorf("incorrect public key type")
 	}
+	// r and s are padded to the byte size of the curve, e.g. 66 bytes each for P-521
+	n := (publicKeyEcdsa.Curve.Params().BitSize + 7) / 8
+	if len(signature) != 2*n {
+		return fmt.Errorf("invalid ECDSA signature length %d, expected %d", len(signature), 2*n)
+	}
 	r, s := &big.Int{}, &big.Int{}
-	n := len(signature) / 2
 	r.SetBytes(signature[:n])
 	s.SetBytes(signature[n:])
 	if ecdsa.Verify(publicKeyEcdsa, digest, r, s) {